@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"chatserver/auth"
+)
+
+const (
+	MaxHandleLength   = 14
+	MinPasswordLength = 8
+	MaxPasswordLength = 13
+)
+
+// loadQuestions reads the sysop's new-user questions, one per line. A
+// missing file just means there is nothing extra to ask.
+func loadQuestions(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var questions []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if q := strings.TrimSpace(scanner.Text()); q != "" {
+			questions = append(questions, q)
+		}
+	}
+	return questions, scanner.Err()
+}
+
+// handleTaken reports whether handle belongs to an account or to an
+// application still waiting on a sysop.
+func handleTaken(handle string, db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM users WHERE username = ? COLLATE NOCASE) +
+		       (SELECT COUNT(*) FROM applications WHERE username = ? COLLATE NOCASE)
+	`, handle, handle).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// apply walks a new caller through the account application and files it
+// for a sysop to approve.
+func apply(conn Conn, db *sql.DB) {
+	questions, err := loadQuestions(conf.Questions)
+	if err != nil {
+		logger.Error("loading questions", "ip", remoteIP(conn), "err", err)
+	}
+	// every pending application holds its handle, so one caller mustn't
+	// be able to file them without end
+	var recent int
+	err = db.QueryRow(`SELECT COUNT(*) FROM applications WHERE ip = ? AND created > ?`, remoteIP(conn), time.Now().Add(-time.Hour).Unix()).Scan(&recent)
+	if err != nil {
+		logger.Error("checking applications", "ip", remoteIP(conn), "err", err)
+		conn.Write([]byte("\r\nSorry, applications are unavailable right now.\r\n"))
+		return
+	}
+	if recent >= conf.ApplicationLimit {
+		logger.Info("refused application", "ip", remoteIP(conn))
+		conn.Write([]byte("\r\nToo many applications from your address. Try again later.\r\n"))
+		return
+	}
+	conn.Write([]byte("\r\nNew user application\r\n"))
+
+	var handle string
+	for {
+		conn.Write([]byte(fmt.Sprintf("\r\nChoose a handle (up to %d characters): ", MaxHandleLength)))
+		handle, err = readLine(conn, MaxHandleLength)
+		if err != nil {
+			return
+		}
+		// the handle is shown on everyone's screen, so nothing in it may
+		// be read by a terminal as a control sequence
+		if handle == "" || len(handle) > MaxHandleLength || strings.ContainsAny(handle, " \t") ||
+			!utf8.ValidString(handle) || strings.IndexFunc(handle, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			conn.Write([]byte(fmt.Sprintf("\r\nHandles must be 1 to %d characters with no spaces or control characters.\r\n", MaxHandleLength)))
+			continue
+		}
+		taken, err := handleTaken(handle, db)
+		if err != nil {
+			logger.Error("checking handle", "ip", remoteIP(conn), "err", err)
+			conn.Write([]byte("\r\nSorry, applications are unavailable right now.\r\n"))
+			return
+		}
+		if taken {
+			conn.Write([]byte(fmt.Sprintf("\r\n%s is already taken.\r\n", handle)))
+			continue
+		}
+		break
+	}
+
+	var password string
+	for {
+		conn.Write([]byte(fmt.Sprintf("\r\nChoose a password (%d to %d characters): ", MinPasswordLength, MaxPasswordLength)))
+		password, err = readPassword(conn, conf.LineLength)
+		if err != nil {
+			return
+		}
+		if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+			conn.Write([]byte(fmt.Sprintf("\r\nPasswords must be %d to %d characters.\r\n", MinPasswordLength, MaxPasswordLength)))
+			continue
+		}
+		conn.Write([]byte("\r\nEnter it again: "))
+		again, err := readPassword(conn, conf.LineLength)
+		if err != nil {
+			return
+		}
+		if again != password {
+			conn.Write([]byte("\r\nThose didn't match.\r\n"))
+			continue
+		}
+		break
+	}
+
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		conn.Write([]byte(fmt.Sprintf("\r\n%s ", q)))
+		answers[i], err = readLine(conn, conf.LineLength)
+		if err != nil {
+			return
+		}
+	}
+
+	if err := saveApplication(handle, password, remoteIP(conn), questions, answers, db); err != nil {
+		logger.Error("saving application", "ip", remoteIP(conn), "err", err)
+		conn.Write([]byte("\r\nSorry, your application could not be saved.\r\n"))
+		return
+	}
+	conn.Write([]byte("\r\nThank you! A sysop will review your application and\r\nassign you a user number.\r\n"))
+}
+
+func saveApplication(handle string, password string, ip string, questions []string, answers []string, db *sql.DB) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO applications (username, password, ip, created) VALUES (?, ?, ?, ?)`, handle, hash, ip, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, q := range questions {
+		_, err := tx.Exec(`INSERT INTO application_answers (application_id, question, answer) VALUES (?, ?, ?)`, id, q, answers[i])
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
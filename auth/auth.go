@@ -0,0 +1,42 @@
+// Package auth hashes and checks account passwords for the chat server and
+// its utilities.
+package auth
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DummyHash is a bcrypt hash, at the cost HashPassword uses, of a random
+// password nobody knows. Checking a password against it when an account
+// doesn't exist makes the failure take as long as a wrong password on a
+// real account, so login timing can't be used to find account numbers.
+const DummyHash = "$2a$10$m5uCTDIDss8VhAGdh8kDX.zhT0rShm2f0mjO4fTmiUQKi6FmcwXei"
+
+// HashPassword returns a salted bcrypt hash of password for storing in the
+// users table.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsHashed reports whether stored is a bcrypt hash rather than a password
+// left over from before passwords were hashed.
+func IsHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword reports whether password matches what is stored for the
+// account. stored may still be plaintext on rows written before hashing;
+// callers should rehash those with HashPassword once the check passes.
+func CheckPassword(stored string, password string) bool {
+	if IsHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Outgoing text is built once and sent to many sessions, some with colour
+// and some without, so colours are written as a two-byte marker (colourMark
+// followed by a code) and each session turns them into ANSI escapes or
+// drops them as the text goes out.
+const colourMark = '\x01'
+
+const (
+	colourReset   = 'r'
+	colourPrivate = 'p'
+	colourSystem  = 's'
+	colourJoin    = 'j'
+	colourLeave   = 'q'
+)
+
+var ansiCodes = map[byte]string{
+	colourReset:   "\033[0m",
+	colourPrivate: "\033[1;33m",
+	colourSystem:  "\033[1;36m",
+	colourJoin:    "\033[1;32m",
+	colourLeave:   "\033[1;31m",
+
+	// user levels, rodent to pwner; capitals are the bold form used for
+	// the handle itself
+	'a': "\033[33m", 'A': "\033[1;33m",
+	'b': "\033[32m", 'B': "\033[1;32m",
+	'c': "\033[36m", 'C': "\033[1;36m",
+	'd': "\033[35m", 'D': "\033[1;35m",
+	'e': "\033[31m", 'E': "\033[1;31m",
+}
+
+// paint wraps text in the given colour.
+func paint(code byte, text string) string {
+	return string([]byte{colourMark, code}) + text + string([]byte{colourMark, colourReset})
+}
+
+// levelColour returns the colour code for a user level.
+func levelColour(level int) byte {
+	switch level {
+	case conf.RodentLevel:
+		return 'a'
+	case conf.NormieLevel:
+		return 'b'
+	case conf.CoSysopLevel:
+		return 'c'
+	case conf.SysopLevel:
+		return 'd'
+	case conf.PwnerLevel:
+		return 'e'
+	}
+	return colourReset
+}
+
+// handleColour returns the bold colour code a handle of the given user
+// level is shown in.
+func handleColour(level int) byte {
+	switch level {
+	case conf.RodentLevel:
+		return 'A'
+	case conf.NormieLevel:
+		return 'B'
+	case conf.CoSysopLevel:
+		return 'C'
+	case conf.SysopLevel:
+		return 'D'
+	case conf.PwnerLevel:
+		return 'E'
+	}
+	return colourReset
+}
+
+// render replaces colour markers in b with ANSI escapes, or strips them
+// when ansi is off.
+func render(b []byte, ansi bool) []byte {
+	if bytes.IndexByte(b, colourMark) < 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b)+32)
+	for i := 0; i < len(b); i++ {
+		if b[i] != colourMark {
+			out = append(out, b[i])
+			continue
+		}
+		if i+1 < len(b) {
+			i++
+			if ansi {
+				out = append(out, ansiCodes[b[i]]...)
+			}
+		}
+	}
+	return out
+}
+
+// sanitize drops control characters from what a caller typed so nobody
+// can push their own escape sequences (or colour markers) to other lines.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// toggleANSI handles "/a [on|off]".
+func toggleANSI(s *Session, args string) {
+	if !conf.ANSIEnabled {
+		s.Write([]byte("ANSI colour is turned off on this system.\r\n"))
+		return
+	}
+	on := !s.ANSI()
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	}
+	s.SetANSI(on)
+	if on {
+		s.Write([]byte(paint(colourSystem, "ANSI colour on.") + "\r\n"))
+	} else {
+		s.Write([]byte("ANSI colour off.\r\n"))
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestLevelColours(t *testing.T) {
+	for _, level := range []int{conf.RodentLevel, conf.NormieLevel, conf.CoSysopLevel, conf.SysopLevel, conf.PwnerLevel} {
+		for _, code := range []byte{levelColour(level), handleColour(level)} {
+			if code == colourReset || ansiCodes[code] == "" {
+				t.Errorf("level %d has no colour for code %q", level, code)
+			}
+		}
+	}
+	if levelColour(99) != colourReset || handleColour(99) != colourReset {
+		t.Errorf("unknown level got a colour")
+	}
+}
+
+func TestRender(t *testing.T) {
+	text := []byte("a " + paint(handleColour(conf.SysopLevel), "bob") + " b")
+	if got := string(render(text, false)); got != "a bob b" {
+		t.Errorf("plain render %q", got)
+	}
+	if got, want := string(render(text, true)), "a \033[1;35mbob\033[0m b"; got != want {
+		t.Errorf("ANSI render %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,542 @@
+// Package config reads varidial.conf, the settings file shared by the chat
+// server and its utilities.
+//
+// Each non-blank line holds one setting, written either as "key value" or
+// "key = value". Values may be wrapped in double quotes. Lines starting with
+// '#' or ';' are comments.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds every setting the server understands.
+type Config struct {
+	Key           string
+	ListenAddress string
+	Port          int
+	TLSPort       int
+	TLSCert       string
+	TLSKey        string
+	SSHPort       int
+	SSHHostKey    string
+	WebPort       int
+	WebProxy      string // proxy whose X-Forwarded-For the gateway trusts
+	MaxLines      int
+	ReservedLines int // lines only co-sysops and up may take
+	LineQueue     int // callers who may wait for a line; 0 turns waiting off
+	// DuplicateLogin is what happens when an account that is already
+	// online logs in again: "refuse" the new login, "replace" the old
+	// session, or "sysops", which lets sysops have several sessions and
+	// replaces everyone else's
+	DuplicateLogin string
+	Database       string
+	ANSIEnabled    bool
+	Questions      string
+	RequestLimit   int
+	// ApplicationLimit is how many new-user applications one address may
+	// file an hour
+	ApplicationLimit int
+	Channels         int
+	ChannelNames     []string
+	HistoryLines     int
+	LineLength       int
+	LogFile          string
+	LogLevel         string
+	LogSize          int
+	LogKeep          int
+	Transcripts      bool
+
+	ShutdownDelay  int
+	ShutdownNotice string
+
+	// flood control: each caller, and each address, may send a burst of
+	// lines and then Rate lines a minute; 0 turns a limit off
+	FloodBurst   int
+	FloodRate    int
+	IPFloodBurst int
+	IPFloodRate  int
+	FloodGag     int // minutes a flooder is gagged for
+
+	// login attempts: tries per connection, seconds of delay after a
+	// failure (doubling as failures from the address pile up), and how
+	// many failures within LockoutTime minutes lock an account or address
+	// out; 0 turns a lockout off
+	LoginTries     int
+	LoginDelay     int
+	AccountLockout int
+	AddressLockout int
+	LockoutTime    int
+
+	RodentLevel  int
+	NormieLevel  int
+	CoSysopLevel int
+	SysopLevel   int
+	PwnerLevel   int
+
+	RodentBrackets  string
+	NormieBrackets  string
+	CoSysopBrackets string
+	SysopBrackets   string
+	PwnerBrackets   string
+
+	// idle limits in minutes; 0 means never log off for idling
+	RodentIdle  int
+	NormieIdle  int
+	CoSysopIdle int
+	SysopIdle   int
+	PwnerIdle   int
+	IdleWarning int // seconds of warning before an idle logoff
+}
+
+// Default returns the settings used for anything varidial.conf leaves out.
+func Default() *Config {
+	return &Config{
+		Port:             8080,
+		SSHHostKey:       "ssh_host_key",
+		MaxLines:         99,
+		DuplicateLogin:   "replace",
+		Database:         "./users.db",
+		Questions:        "questions.txt",
+		RequestLimit:     3,
+		ApplicationLimit: 3,
+		Channels:         4,
+		HistoryLines:     50,
+		LineLength:       240,
+		LogLevel:         "info",
+		LogSize:          10,
+		LogKeep:          5,
+
+		ShutdownDelay:  30,
+		ShutdownNotice: "The system is shutting down",
+
+		FloodBurst:   5,
+		FloodRate:    30,
+		IPFloodBurst: 10,
+		IPFloodRate:  60,
+		FloodGag:     5,
+
+		LoginTries:     3,
+		LoginDelay:     2,
+		AccountLockout: 5,
+		AddressLockout: 10,
+		LockoutTime:    15,
+
+		RodentLevel:  0,
+		NormieLevel:  1,
+		CoSysopLevel: 2,
+		SysopLevel:   3,
+		PwnerLevel:   4,
+
+		RodentBrackets:  "()",
+		NormieBrackets:  "[)",
+		CoSysopBrackets: "<)",
+		SysopBrackets:   "<]",
+		PwnerBrackets:   "<>",
+
+		RodentIdle:  10,
+		NormieIdle:  20,
+		CoSysopIdle: 60,
+		IdleWarning: 60,
+	}
+}
+
+// Load reads the configuration file at filename on top of the defaults.
+func Load(filename string) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(filename, file)
+}
+
+// Parse reads settings from r on top of the defaults. name is only used to
+// label errors.
+func Parse(name string, r io.Reader) (*Config, error) {
+	c := Default()
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		key, value, err := splitSetting(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineNo, err)
+		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s already set on line %d", name, lineNo, key, prev)
+		}
+		seen[key] = lineNo
+		if err := c.set(key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return c, nil
+}
+
+// splitSetting breaks a line into its key and value. The key runs up to the
+// first space or '='; an '=' after the key is optional, so values themselves
+// may contain '='.
+func splitSetting(line string) (string, string, error) {
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return "", "", fmt.Errorf("%s has no value", line)
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("setting has no name")
+	}
+	if rest == "" {
+		return "", "", fmt.Errorf("%s has no value", key)
+	}
+	if strings.HasPrefix(rest, `"`) {
+		unquoted, err := strconv.Unquote(rest)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: bad quoted value %s", key, rest)
+		}
+		rest = unquoted
+	}
+	return key, rest, nil
+}
+
+// field maps a setting name to the Config field it fills.
+func (c *Config) field(key string) interface{} {
+	switch key {
+	case "key":
+		return &c.Key
+	case "listenaddress":
+		return &c.ListenAddress
+	case "port":
+		return &c.Port
+	case "tlsport":
+		return &c.TLSPort
+	case "tlscert":
+		return &c.TLSCert
+	case "tlskey":
+		return &c.TLSKey
+	case "sshport":
+		return &c.SSHPort
+	case "sshhostkey":
+		return &c.SSHHostKey
+	case "webport":
+		return &c.WebPort
+	case "webproxy":
+		return &c.WebProxy
+	case "database":
+		return &c.Database
+	case "ansienabled":
+		return &c.ANSIEnabled
+	case "questions":
+		return &c.Questions
+	case "requestlimit":
+		return &c.RequestLimit
+	case "applicationlimit":
+		return &c.ApplicationLimit
+	case "channels":
+		return &c.Channels
+	case "channelnames":
+		return &c.ChannelNames
+	case "historylines":
+		return &c.HistoryLines
+	case "linelength":
+		return &c.LineLength
+	case "maxlines":
+		return &c.MaxLines
+	case "reservedlines":
+		return &c.ReservedLines
+	case "linequeue":
+		return &c.LineQueue
+	case "duplicatelogin":
+		return &c.DuplicateLogin
+	case "logfile":
+		return &c.LogFile
+	case "loglevel":
+		return &c.LogLevel
+	case "logsize":
+		return &c.LogSize
+	case "logkeep":
+		return &c.LogKeep
+	case "transcripts":
+		return &c.Transcripts
+	case "shutdowndelay":
+		return &c.ShutdownDelay
+	case "shutdownnotice":
+		return &c.ShutdownNotice
+	case "floodburst":
+		return &c.FloodBurst
+	case "floodrate":
+		return &c.FloodRate
+	case "ipfloodburst":
+		return &c.IPFloodBurst
+	case "ipfloodrate":
+		return &c.IPFloodRate
+	case "floodgag":
+		return &c.FloodGag
+	case "logintries":
+		return &c.LoginTries
+	case "logindelay":
+		return &c.LoginDelay
+	case "accountlockout":
+		return &c.AccountLockout
+	case "addresslockout":
+		return &c.AddressLockout
+	case "lockouttime":
+		return &c.LockoutTime
+	case "rodentlevel":
+		return &c.RodentLevel
+	case "normielevel":
+		return &c.NormieLevel
+	case "cosysoplevel":
+		return &c.CoSysopLevel
+	case "sysoplevel":
+		return &c.SysopLevel
+	case "pwnerlevel":
+		return &c.PwnerLevel
+	case "robrackets":
+		return &c.RodentBrackets
+	case "normiebrackets":
+		return &c.NormieBrackets
+	case "cobrackets":
+		return &c.CoSysopBrackets
+	case "sysopbrackets":
+		return &c.SysopBrackets
+	case "pwnerbrackets":
+		return &c.PwnerBrackets
+	case "rodentidle":
+		return &c.RodentIdle
+	case "normieidle":
+		return &c.NormieIdle
+	case "cosysopidle":
+		return &c.CoSysopIdle
+	case "sysopidle":
+		return &c.SysopIdle
+	case "pwneridle":
+		return &c.PwnerIdle
+	case "idlewarning":
+		return &c.IdleWarning
+	}
+	return nil
+}
+
+func (c *Config) set(key string, value string) error {
+	switch f := c.field(key).(type) {
+	case *string:
+		*f = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", key, value)
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be 1 or 0, got %q", key, value)
+		}
+		*f = b
+	case *[]string:
+		*f = nil
+		for _, item := range strings.Split(value, ",") {
+			*f = append(*f, strings.TrimSpace(item))
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", c.Port)
+	}
+	if c.TLSPort < 0 || c.TLSPort > 65535 {
+		return fmt.Errorf("tlsport %d is out of range", c.TLSPort)
+	}
+	if c.TLSPort != 0 && (c.TLSCert == "" || c.TLSKey == "") {
+		return fmt.Errorf("tlscert and tlskey must be set when tlsport is")
+	}
+	if c.SSHPort < 0 || c.SSHPort > 65535 {
+		return fmt.Errorf("sshport %d is out of range", c.SSHPort)
+	}
+	if c.SSHPort != 0 && c.SSHHostKey == "" {
+		return fmt.Errorf("sshhostkey must be set when sshport is")
+	}
+	if c.WebPort < 0 || c.WebPort > 65535 {
+		return fmt.Errorf("webport %d is out of range", c.WebPort)
+	}
+	if c.WebProxy != "" && net.ParseIP(c.WebProxy) == nil {
+		return fmt.Errorf("webproxy must be an IP address, got %q", c.WebProxy)
+	}
+	if c.RequestLimit < 0 {
+		return fmt.Errorf("requestlimit must not be negative")
+	}
+	if c.ApplicationLimit < 0 {
+		return fmt.Errorf("applicationlimit must not be negative")
+	}
+	if c.Channels < 1 {
+		return fmt.Errorf("channels must be at least 1")
+	}
+	if len(c.ChannelNames) > c.Channels {
+		return fmt.Errorf("channelnames lists %d names for %d channels", len(c.ChannelNames), c.Channels)
+	}
+	if c.HistoryLines < 0 {
+		return fmt.Errorf("historylines must not be negative")
+	}
+	if c.LineLength < 1 {
+		return fmt.Errorf("linelength must be at least 1")
+	}
+	if c.MaxLines < 1 {
+		return fmt.Errorf("maxlines must be at least 1")
+	}
+	if c.ReservedLines < 0 || c.ReservedLines > c.MaxLines {
+		return fmt.Errorf("reservedlines must be between 0 and maxlines")
+	}
+	if c.LineQueue < 0 {
+		return fmt.Errorf("linequeue must not be negative")
+	}
+	switch c.DuplicateLogin {
+	case "refuse", "replace", "sysops":
+	default:
+		return fmt.Errorf("duplicatelogin must be refuse, replace or sysops, got %q", c.DuplicateLogin)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("loglevel must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if c.LogSize < 0 || c.LogKeep < 0 {
+		return fmt.Errorf("logsize and logkeep must not be negative")
+	}
+	if c.FloodBurst < 1 || c.IPFloodBurst < 1 {
+		return fmt.Errorf("floodburst and ipfloodburst must be at least 1")
+	}
+	if c.FloodRate < 0 || c.IPFloodRate < 0 {
+		return fmt.Errorf("floodrate and ipfloodrate must not be negative")
+	}
+	if c.FloodGag < 1 {
+		return fmt.Errorf("floodgag must be at least 1")
+	}
+	if c.LoginTries < 1 {
+		return fmt.Errorf("logintries must be at least 1")
+	}
+	if c.LoginDelay < 0 || c.AccountLockout < 0 || c.AddressLockout < 0 {
+		return fmt.Errorf("logindelay, accountlockout and addresslockout must not be negative")
+	}
+	if c.LockoutTime < 1 {
+		return fmt.Errorf("lockouttime must be at least 1")
+	}
+	if c.ShutdownDelay < 0 {
+		return fmt.Errorf("shutdowndelay must not be negative")
+	}
+	if c.Database == "" {
+		return fmt.Errorf("database must not be empty")
+	}
+	if c.IdleWarning < 0 {
+		return fmt.Errorf("idlewarning must not be negative")
+	}
+	levels := make(map[int]bool)
+	for _, l := range c.levels() {
+		if l.idle < 0 {
+			return fmt.Errorf("idle limit for level %d must not be negative", l.level)
+		}
+		if len(l.brackets) != 2 {
+			return fmt.Errorf("brackets for level %d must be two characters, got %q", l.level, l.brackets)
+		}
+		if levels[l.level] {
+			return fmt.Errorf("level %d is assigned to more than one rank", l.level)
+		}
+		levels[l.level] = true
+	}
+	return nil
+}
+
+// rank is everything configured per user level.
+type rank struct {
+	level    int
+	brackets string
+	idle     int
+}
+
+func (c *Config) levels() []rank {
+	return []rank{
+		{c.RodentLevel, c.RodentBrackets, c.RodentIdle},
+		{c.NormieLevel, c.NormieBrackets, c.NormieIdle},
+		{c.CoSysopLevel, c.CoSysopBrackets, c.CoSysopIdle},
+		{c.SysopLevel, c.SysopBrackets, c.SysopIdle},
+		{c.PwnerLevel, c.PwnerBrackets, c.PwnerIdle},
+	}
+}
+
+// Addr is the host:port the telnet listener binds to.
+func (c *Config) Addr() string {
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.Port))
+}
+
+// TLSAddr is the host:port the TLS telnet listener binds to. It is only
+// used when TLSPort is set.
+func (c *Config) TLSAddr() string {
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.TLSPort))
+}
+
+// SSHAddr is the host:port the SSH listener binds to. It is only used
+// when SSHPort is set.
+func (c *Config) SSHAddr() string {
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.SSHPort))
+}
+
+// WebAddr is the host:port the web gateway binds to. It is only used when
+// WebPort is set.
+func (c *Config) WebAddr() string {
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.WebPort))
+}
+
+// Brackets returns the opening and closing bracket shown around a handle
+// of the given user level.
+func (c *Config) Brackets(level int) (open byte, close byte, ok bool) {
+	for _, l := range c.levels() {
+		if l.level == level {
+			return l.brackets[0], l.brackets[1], true
+		}
+	}
+	return 0, 0, false
+}
+
+// IdleLimit returns how many minutes a user of the given level may sit
+// idle before being logged off, or 0 if they never are.
+func (c *Config) IdleLimit(level int) int {
+	for _, l := range c.levels() {
+		if l.level == level {
+			return l.idle
+		}
+	}
+	return 0
+}
+
+// ChannelName returns the sysop's name for channel, or "" if it has none.
+func (c *Config) ChannelName(channel int) string {
+	if channel < 1 || channel > len(c.ChannelNames) {
+		return ""
+	}
+	return c.ChannelNames[channel-1]
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSyntax(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		check func(*Config) bool
+	}{
+		{"space", "port 2323", func(c *Config) bool { return c.Port == 2323 }},
+		{"tab", "port\t2323", func(c *Config) bool { return c.Port == 2323 }},
+		{"equals", "port = 2323", func(c *Config) bool { return c.Port == 2323 }},
+		{"equals without spaces", "port=2323", func(c *Config) bool { return c.Port == 2323 }},
+		{"key case", "PORT 2323", func(c *Config) bool { return c.Port == 2323 }},
+		{"quoted", `key "two words"`, func(c *Config) bool { return c.Key == "two words" }},
+		{"quoted with equals", `key = "a = b"`, func(c *Config) bool { return c.Key == "a = b" }},
+		{"quoted empty", `logfile ""`, func(c *Config) bool { return c.LogFile == "" }},
+		{"quoted escape", `shutdownnotice "say \"bye\""`, func(c *Config) bool { return c.ShutdownNotice == `say "bye"` }},
+		{"equals in value", "key a=b", func(c *Config) bool { return c.Key == "a=b" }},
+		{"equals in value after equals", "key = a=b", func(c *Config) bool { return c.Key == "a=b" }},
+		{"inner spaces kept", "shutdownnotice back  soon", func(c *Config) bool { return c.ShutdownNotice == "back  soon" }},
+		{"bool", "ansienabled 1", func(c *Config) bool { return c.ANSIEnabled }},
+		{"list", "channels 3\nchannelnames Main, Games ,Tech", func(c *Config) bool {
+			return reflect.DeepEqual(c.ChannelNames, []string{"Main", "Games", "Tech"})
+		}},
+		{"comments and blanks", "# port 1\n; port 2\n\n   \nport 2323", func(c *Config) bool { return c.Port == 2323 }},
+		{"defaults kept", "port 2323", func(c *Config) bool { return c.MaxLines == Default().MaxLines }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse("test.conf", strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.input, err)
+			}
+			if !tt.check(c) {
+				t.Fatalf("Parse(%q) gave the wrong setting: %+v", tt.input, c)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unknown key", "colour 1", `test.conf:1: unknown setting "colour"`},
+		{"no value", "\nport", "test.conf:2: port has no value"},
+		{"no value after equals", "port =", "test.conf:1: port has no value"},
+		{"no name", "= 5", "test.conf:1: setting has no name"},
+		{"duplicate", "port 1\n# comment\nPort = 2", "test.conf:3: port already set on line 1"},
+		{"bad quote", `key "open`, `test.conf:1: key: bad quoted value "open`},
+		{"not a number", "port telnet", `test.conf:1: port must be a number, got "telnet"`},
+		{"not a bool", "ansienabled yes", `test.conf:1: ansienabled must be 1 or 0, got "yes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("test.conf", strings.NewReader(tt.input))
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("Parse(%q) = %v, want %q", tt.input, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"port 0", "port 0 is out of range"},
+		{"port 65536", "port 65536 is out of range"},
+		{"tlsport -1", "tlsport -1 is out of range"},
+		{"tlsport 992", "tlscert and tlskey must be set when tlsport is"},
+		{"tlsport 992\ntlscert cert.pem", "tlscert and tlskey must be set when tlsport is"},
+		{"sshport 70000", "sshport 70000 is out of range"},
+		{"sshport 22\nsshhostkey \"\"", "sshhostkey must be set when sshport is"},
+		{"webport -1", "webport -1 is out of range"},
+		{"webproxy proxy.example.com", `webproxy must be an IP address, got "proxy.example.com"`},
+		{"requestlimit -1", "requestlimit must not be negative"},
+		{"applicationlimit -1", "applicationlimit must not be negative"},
+		{"channels 0", "channels must be at least 1"},
+		{"channels 1\nchannelnames Main,Games", "channelnames lists 2 names for 1 channels"},
+		{"historylines -1", "historylines must not be negative"},
+		{"linelength 0", "linelength must be at least 1"},
+		{"maxlines 0", "maxlines must be at least 1"},
+		{"reservedlines -1", "reservedlines must be between 0 and maxlines"},
+		{"maxlines 2\nreservedlines 3", "reservedlines must be between 0 and maxlines"},
+		{"linequeue -1", "linequeue must not be negative"},
+		{"duplicatelogin allow", `duplicatelogin must be refuse, replace or sysops, got "allow"`},
+		{"loglevel trace", `loglevel must be debug, info, warn or error, got "trace"`},
+		{"logsize -1", "logsize and logkeep must not be negative"},
+		{"logkeep -1", "logsize and logkeep must not be negative"},
+		{"floodburst 0", "floodburst and ipfloodburst must be at least 1"},
+		{"ipfloodburst 0", "floodburst and ipfloodburst must be at least 1"},
+		{"floodrate -1", "floodrate and ipfloodrate must not be negative"},
+		{"ipfloodrate -1", "floodrate and ipfloodrate must not be negative"},
+		{"floodgag 0", "floodgag must be at least 1"},
+		{"logintries 0", "logintries must be at least 1"},
+		{"logindelay -1", "logindelay, accountlockout and addresslockout must not be negative"},
+		{"accountlockout -1", "logindelay, accountlockout and addresslockout must not be negative"},
+		{"addresslockout -1", "logindelay, accountlockout and addresslockout must not be negative"},
+		{"lockouttime 0", "lockouttime must be at least 1"},
+		{"shutdowndelay -1", "shutdowndelay must not be negative"},
+		{`database ""`, "database must not be empty"},
+		{"idlewarning -1", "idlewarning must not be negative"},
+		{"normieidle -1", "idle limit for level 1 must not be negative"},
+		{"sysopbrackets <", `brackets for level 3 must be two characters, got "<"`},
+		{"pwnerbrackets <<>>", `brackets for level 4 must be two characters, got "<<>>"`},
+		{"pwnerlevel 3", "level 3 is assigned to more than one rank"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse("test.conf", strings.NewReader(tt.input))
+			if want := "test.conf: " + tt.want; err == nil || err.Error() != want {
+				t.Fatalf("Parse(%q) = %v, want %q", tt.input, err, want)
+			}
+		})
+	}
+}
+
+func TestShippedConfig(t *testing.T) {
+	if _, err := Load("../varidial.conf"); err != nil {
+		t.Fatalf("varidial.conf doesn't load: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// writeTimeout is how long one write to a caller may take. A caller whose
+// connection died without closing stops reading, and once their send
+// buffer fills every write to them would block, holding up whoever is
+// talking to them; they are hung up on instead, which ends their session.
+var writeTimeout = 10 * time.Second
+
+// timedWrite runs write, hanging up with hangUp if it hasn't finished
+// within writeTimeout.
+func timedWrite(write func() error, hangUp func() error) error {
+	timer := time.AfterFunc(writeTimeout, func() { hangUp() })
+	defer timer.Stop()
+	return write()
+}
+
+// Conn is a caller's connection, whichever listener it came in on. Once
+// someone is logged in the chat only talks to them through this.
+type Conn interface {
+	io.Writer
+	ReadKey() (byte, error)
+	SetEcho(serverEchoes bool)
+	Size() (int, int)
+	Dumb() bool
+	RemoteAddr() net.Addr
+	Close() error
+	// Secure reports whether the connection is encrypted.
+	Secure() bool
+	// Kind names the listener the caller came in on.
+	Kind() string
+}
+
+// keyReader turns a stream of typed bytes into keys. Every form of Enter
+// (CR LF, CR NUL, a lone CR or a lone LF) comes back as a single '\r', and
+// stray NULs are dropped.
+type keyReader struct {
+	reader *bufio.Reader
+
+	// skipLF is set after a CR so the LF or NUL that usually follows it
+	// isn't read as a second Enter.
+	skipLF bool
+}
+
+// ReadKey returns the next key the caller typed.
+func (k *keyReader) ReadKey() (byte, error) {
+	for {
+		ch, err := k.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if k.skipLF {
+			k.skipLF = false
+			if ch == '\n' || ch == 0 {
+				continue
+			}
+		}
+		switch ch {
+		case '\r':
+			k.skipLF = true
+			return '\r', nil
+		case '\n':
+			return '\r', nil
+		case 0:
+			continue
+		}
+		return ch, nil
+	}
+}
+
+// ansiTerminals are the terminal types, or the start of them, known to
+// handle ANSI colour and line erasing.
+var ansiTerminals = []string{
+	"ANSI", "VT1", "VT2", "VT3", "VT4", "VT5", "XTERM", "LINUX", "SCREEN",
+	"TMUX", "RXVT", "PUTTY", "SYNCTERM", "CYGWIN", "KONSOLE", "GNOME", "ALACRITTY",
+	"KITTY", "WEZTERM", "ITERM", "CONEMU", "MINTTY", "NETRUNNER", "QODEM",
+}
+
+// dumbTerminal reports whether a terminal type can't be trusted with ANSI
+// escapes. A client that didn't say what it is ("") or named something
+// unknown gets plain text; the caller can still turn colour on with /a.
+func dumbTerminal(termType string) bool {
+	for _, prefix := range ansiTerminals {
+		if strings.HasPrefix(termType, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisterExclusive(t *testing.T) {
+	withLines(t, 5, 0, 0)
+	h := newHub()
+	register(t, h, 7, false)
+	line := h.ReserveLine(false)
+	dup := newTestSession(line, 7)
+	if h.Register(dup, true) {
+		t.Fatal("second session on account 7 registered exclusively")
+	}
+	h.ReleaseLine(line)
+	if !h.Register(dup, false) {
+		t.Fatal("second session on account 7 refused when allowed")
+	}
+	if n := len(h.ByNumber(7)); n != 2 {
+		t.Fatalf("ByNumber found %d sessions, want 2", n)
+	}
+}
+
+func TestReplaceHandsLineStraightOver(t *testing.T) {
+	withLines(t, 1, 0, 5)
+	h := newHub()
+	old := register(t, h, 7, false)
+	w := h.Wait(false)
+	s := newTestSession(0, 7)
+	if got := h.Replace(s); len(got) != 1 || got[0] != old {
+		t.Fatalf("Replace took off %v, want the old session", got)
+	}
+	if s.User.LineNumber != old.User.LineNumber || h.ByLine(s.User.LineNumber) != s {
+		t.Fatalf("new session on line %d, want %d", s.User.LineNumber, old.User.LineNumber)
+	}
+	select {
+	case line := <-w.Line:
+		t.Fatalf("waiter was handed line %d the new login should have", line)
+	default:
+	}
+	// the old session's goroutine may still be finishing a command
+	if h.SetChannel(old, 2) || h.Mute(old, time.Now().Add(time.Minute)) {
+		t.Fatal("replaced session could still change its old line")
+	}
+	if _, ok := h.User(old); ok {
+		t.Fatal("replaced session still found on the hub")
+	}
+	if s.User.Channel != 1 || !h.MutedUntil(s).IsZero() {
+		t.Fatal("replaced session's commands reached the new login")
+	}
+	if h.Unregister(old) {
+		t.Fatal("replaced session could still be unregistered")
+	}
+	if h.ByLine(s.User.LineNumber) != s {
+		t.Fatal("replaced session's logoff took the new session off")
+	}
+}
+
+func TestReplaceDisplacesRacingLogin(t *testing.T) {
+	withLines(t, 3, 0, 0)
+	h := newHub()
+	// two logins to the same account both found it offline and took lines
+	first := newTestSession(h.ReserveLine(false), 7)
+	second := newTestSession(h.ReserveLine(false), 7)
+	if got := h.Replace(first); len(got) != 0 {
+		t.Fatalf("first login replaced %d sessions, want none", len(got))
+	}
+	if got := h.Replace(second); len(got) != 1 || got[0] != first {
+		t.Fatalf("second login replaced %v, want the first", got)
+	}
+	if n := len(h.ByNumber(7)); n != 1 {
+		t.Fatalf("%d sessions on account 7, want 1", n)
+	}
+	if line := h.ReserveLine(false); line != first.User.LineNumber {
+		t.Fatalf("next line handed out is %d, want the first login's freed line %d", line, first.User.LineNumber)
+	}
+}
+
+func TestReplaceWithoutLineDoesNothing(t *testing.T) {
+	withLines(t, 2, 0, 0)
+	h := newHub()
+	s := newTestSession(0, 7)
+	if got := h.Replace(s); got != nil || s.User.LineNumber != 0 || len(h.taken) != 0 {
+		t.Fatalf("Replace with the account offline changed the hub: %v, line %d", got, s.User.LineNumber)
+	}
+}
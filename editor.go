@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// HistorySize is how many of a caller's own lines the up and down arrows
+// can recall.
+const HistorySize = 20
+
+// lineEditor is the server-side input line for a logged-in caller. The
+// client sends every key as it is typed and the server does the echo, so
+// chat arriving mid-line can be printed above what the caller is typing
+// instead of through the middle of it.
+type lineEditor struct {
+	buf     []byte
+	history []string
+	// recall is the history entry shown by the arrow keys;
+	// len(history) means the caller's own, unsent line.
+	recall int
+	saved  []byte // the unsent line while browsing history
+	esc    int    // progress through an escape sequence
+	// refused is set while the rest of a character turned away at the
+	// length limit is still arriving
+	refused bool
+}
+
+// key applies one key typed by the caller. It returns what to echo back
+// and, when the key was Enter, the finished line.
+func (e *lineEditor) key(ch byte, limit int) (echo []byte, line string, done bool) {
+	switch e.esc {
+	case 1:
+		e.esc = 0
+		if ch == '[' || ch == 'O' {
+			e.esc = 2
+		}
+		return nil, "", false
+	case 2:
+		if ch >= '0' && ch <= '9' || ch == ';' {
+			return nil, "", false
+		}
+		e.esc = 0
+		switch ch {
+		case 'A':
+			return e.browse(-1), "", false
+		case 'B':
+			return e.browse(1), "", false
+		}
+		// cursor movement and the like aren't supported
+		return nil, "", false
+	}
+
+	switch ch {
+	case '\r':
+		line = string(e.buf)
+		if strings.TrimSpace(line) != "" {
+			e.history = append(e.history, line)
+			if len(e.history) > HistorySize {
+				e.history = e.history[1:]
+			}
+		}
+		e.buf = e.buf[:0]
+		e.saved = nil
+		e.recall = len(e.history)
+		return []byte("\r\n"), line, true
+	case 0x1b:
+		e.esc = 1
+	case '\b', 0x7f:
+		if len(e.buf) > 0 {
+			_, size := utf8.DecodeLastRune(e.buf)
+			e.buf = e.buf[:len(e.buf)-size]
+			echo = rubout(1)
+		}
+	case 0x15: // ^U
+		echo = rubout(utf8.RuneCount(e.buf))
+		e.buf = e.buf[:0]
+	case 0x17: // ^W
+		end := len(e.buf)
+		for end > 0 && e.buf[end-1] == ' ' {
+			end--
+		}
+		for end > 0 && e.buf[end-1] != ' ' {
+			end--
+		}
+		echo = rubout(utf8.RuneCount(e.buf[end:]))
+		e.buf = e.buf[:end]
+	default:
+		if ch < 0x20 {
+			return nil, "", false
+		}
+		// a multi-byte character is let in or turned away whole, so
+		// one is never cut in half
+		if ch&0xc0 == 0x80 {
+			if e.refused {
+				return nil, "", false
+			}
+		} else if e.refused = utf8.RuneCount(e.buf) >= limit; e.refused {
+			return []byte{'\a'}, "", false
+		}
+		e.buf = append(e.buf, ch)
+		echo = []byte{ch}
+	}
+	return echo, "", false
+}
+
+// browse moves through the caller's history by dir and replaces the line
+// with the entry found there.
+func (e *lineEditor) browse(dir int) []byte {
+	next := e.recall + dir
+	if next < 0 || next > len(e.history) {
+		return []byte{'\a'}
+	}
+	if e.recall == len(e.history) {
+		e.saved = append([]byte(nil), e.buf...)
+	}
+	e.recall = next
+	echo := rubout(utf8.RuneCount(e.buf))
+	if next == len(e.history) {
+		e.buf = append(e.buf[:0], e.saved...)
+	} else {
+		e.buf = append(e.buf[:0], e.history[next]...)
+	}
+	return append(echo, e.buf...)
+}
+
+// clear returns what wipes the partial line from the caller's screen so
+// other output can be written in its place.
+func (e *lineEditor) clear(ansi bool) []byte {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	if ansi {
+		return []byte("\r\033[K")
+	}
+	return []byte("\r" + strings.Repeat(" ", utf8.RuneCount(e.buf)) + "\r")
+}
+
+func rubout(n int) []byte {
+	return bytes.Repeat([]byte("\b \b"), n)
+}
+
+// lineLimit is the longest line the caller may type: linelength from the
+// config, cut down to fit on one row of their screen so the line can
+// always be redrawn in place.
+func (s *Session) lineLimit() int {
+	limit := conf.LineLength
+	if width, _ := s.Conn.Size(); width > 1 && width-1 < limit {
+		limit = width - 1
+	}
+	return limit
+}
+
+// ReadLine reads the caller's next line through their line editor.
+func (s *Session) ReadLine() (string, error) {
+	for {
+		ch, err := s.Conn.ReadKey()
+		if err != nil {
+			return "", err
+		}
+		hub.Touch(s)
+		s.writeMu.Lock()
+		echo, line, done := s.editor.key(ch, s.lineLimit())
+		if len(echo) > 0 {
+			_, err = s.Conn.Write(echo)
+		}
+		s.writeMu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if done {
+			return line, nil
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// typeKeys feeds keys to e one byte at a time, returning everything echoed
+// and the line finished by the last Enter, if any.
+func typeKeys(e *lineEditor, keys string, limit int) (echo string, line string, done bool) {
+	var out bytes.Buffer
+	for i := 0; i < len(keys); i++ {
+		b, l, d := e.key(keys[i], limit)
+		out.Write(b)
+		if d {
+			line, done = l, true
+		}
+	}
+	return out.String(), line, done
+}
+
+func TestEditorKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys string
+		line string
+		echo string
+	}{
+		{"typing", "hi\r", "hi", "hi\r\n"},
+		{"backspace", "hix\b\r", "hi", "hix\b \b\r\n"},
+		{"delete", "hix\x7f\r", "hi", "hix\b \b\r\n"},
+		{"backspace on empty line", "\bhi\r", "hi", "hi\r\n"},
+		{"backspace over multi-byte", "caf\xc3\xa9\b\r", "caf", "caf\xc3\xa9\b \b\r\n"},
+		{"backspace over four bytes", "a\xf0\x9f\x98\x80\b\r", "a", "a\xf0\x9f\x98\x80\b \b\r\n"},
+		{"^U", "hello\x15hi\r", "hi", "hello" + string(rubout(5)) + "hi\r\n"},
+		{"^U counts characters", "h\xc3\xa9\x15\r", "", "h\xc3\xa9" + string(rubout(2)) + "\r\n"},
+		{"^W", "one two\x17\r", "one ", "one two" + string(rubout(3)) + "\r\n"},
+		{"^W with trailing spaces", "one two  \x17\r", "one ", "one two  " + string(rubout(5)) + "\r\n"},
+		{"^W on one word", "one\x17\r", "", "one" + string(rubout(3)) + "\r\n"},
+		{"other control keys ignored", "a\x01\x02b\r", "ab", "ab\r\n"},
+		{"left arrow ignored", "ab\x1b[Dc\r", "abc", "abc\r\n"},
+		{"numbered sequence ignored", "ab\x1b[3~c\r", "abc", "abc\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e lineEditor
+			echo, line, done := typeKeys(&e, tt.keys, 80)
+			if !done || line != tt.line {
+				t.Fatalf("line %q (done %v), want %q", line, done, tt.line)
+			}
+			if echo != tt.echo {
+				t.Fatalf("echo %q, want %q", echo, tt.echo)
+			}
+		})
+	}
+}
+
+func TestEditorLimit(t *testing.T) {
+	var e lineEditor
+	echo, _, _ := typeKeys(&e, "abcd", 3)
+	if echo != "abc\a" {
+		t.Fatalf("echo %q, want the fourth key refused with a bell", echo)
+	}
+	// the limit is in characters, and a character is never cut in half
+	e = lineEditor{}
+	typeKeys(&e, "ab\xc3\xa9\xc3\xa9", 3)
+	if got := string(e.buf); got != "ab\xc3\xa9" {
+		t.Fatalf("line %q, want %q", got, "ab\xc3\xa9")
+	}
+}
+
+func TestEditorHistory(t *testing.T) {
+	const up, down = "\x1b[A", "\x1b[B"
+	var e lineEditor
+	typeKeys(&e, "first\r", 80)
+	typeKeys(&e, "second\r", 80)
+	typeKeys(&e, "   \r", 80) // blank lines aren't kept
+
+	typeKeys(&e, "draft", 80)
+	echo, _, _ := typeKeys(&e, up, 80)
+	if got := string(e.buf); got != "second" {
+		t.Fatalf("up recalled %q, want %q", got, "second")
+	}
+	if want := string(rubout(5)) + "second"; echo != want {
+		t.Fatalf("echo %q, want %q", echo, want)
+	}
+	typeKeys(&e, up, 80)
+	if got := string(e.buf); got != "first" {
+		t.Fatalf("second up recalled %q, want %q", got, "first")
+	}
+	if echo, _, _ := typeKeys(&e, up, 80); echo != "\a" {
+		t.Fatalf("up past the oldest line echoed %q, want a bell", echo)
+	}
+	// SS3 arrows, as sent in application cursor mode, work the same
+	typeKeys(&e, "\x1bOB", 80)
+	if got := string(e.buf); got != "second" {
+		t.Fatalf("down recalled %q, want %q", got, "second")
+	}
+	typeKeys(&e, down, 80)
+	if got := string(e.buf); got != "draft" {
+		t.Fatalf("down past the newest line gave %q, want the unsent %q", got, "draft")
+	}
+	if echo, _, _ := typeKeys(&e, down, 80); echo != "\a" {
+		t.Fatalf("down past the unsent line echoed %q, want a bell", echo)
+	}
+
+	// a recalled line can be edited and sent
+	typeKeys(&e, up, 80)
+	if _, line, _ := typeKeys(&e, "!\r", 80); line != "second!" {
+		t.Fatalf("sent %q, want %q", line, "second!")
+	}
+	if got := e.history[len(e.history)-1]; got != "second!" {
+		t.Fatalf("newest history entry %q, want %q", got, "second!")
+	}
+	typeKeys(&e, down, 80)
+	if len(e.buf) != 0 {
+		t.Fatalf("down on a fresh line gave %q, want it left empty", e.buf)
+	}
+}
+
+func TestEditorHistorySize(t *testing.T) {
+	var e lineEditor
+	for i := 0; i < HistorySize+5; i++ {
+		typeKeys(&e, string(rune('a'+i))+"\r", 80)
+	}
+	if len(e.history) != HistorySize {
+		t.Fatalf("history holds %d lines, want %d", len(e.history), HistorySize)
+	}
+	if e.history[0] != "f" {
+		t.Fatalf("oldest line kept is %q, want %q", e.history[0], "f")
+	}
+}
+
+func TestEditorClear(t *testing.T) {
+	var e lineEditor
+	if got := e.clear(true); got != nil {
+		t.Fatalf("clearing an empty line gave %q", got)
+	}
+	typeKeys(&e, "h\xc3\xa9", 80)
+	if got := string(e.clear(true)); got != "\r\033[K" {
+		t.Fatalf("ANSI clear %q", got)
+	}
+	if got := string(e.clear(false)); got != "\r  \r" {
+		t.Fatalf("plain clear %q, want two characters blanked", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// floodWarnStrikes and floodGagStrikes are how many times in a row a
+	// caller may go over the limit before being warned and then gagged.
+	floodWarnStrikes = 3
+	floodGagStrikes  = 5
+	// floodCalm is how long a caller must stay under the limit for their
+	// strikes to be forgotten.
+	floodCalm = time.Minute
+	// ipBucketExpiry is how long an address's bucket is kept once it
+	// stops sending.
+	ipBucketExpiry = 10 * time.Minute
+)
+
+// bucket is a token bucket holding up to burst lines, refilled at
+// perMinute lines a minute.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token for a line sent at now and returns how long the
+// sender has to wait for it, which is zero while they are within the
+// limit. A perMinute of zero means no limit.
+func (b *bucket) reserve(now time.Time, burst int, perMinute int) time.Duration {
+	if perMinute <= 0 {
+		return 0
+	}
+	rate := float64(perMinute) / 60
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// floodState is a session's own bucket and how often it has gone over the
+// limit lately. Only the session's own goroutine touches it.
+type floodState struct {
+	bucket
+	strikes    int
+	lastStrike time.Time
+}
+
+// ipBuckets are shared by everyone calling from the same address, so
+// opening more lines doesn't buy a flooder more room.
+var ipBuckets = struct {
+	sync.Mutex
+	m         map[string]*bucket
+	lastPrune time.Time
+}{m: make(map[string]*bucket)}
+
+func reserveIP(ip string, now time.Time) time.Duration {
+	ipBuckets.Lock()
+	defer ipBuckets.Unlock()
+	if now.Sub(ipBuckets.lastPrune) > ipBucketExpiry {
+		for addr, b := range ipBuckets.m {
+			if now.Sub(b.last) > ipBucketExpiry {
+				delete(ipBuckets.m, addr)
+			}
+		}
+		ipBuckets.lastPrune = now
+	}
+	b, ok := ipBuckets.m[ip]
+	if !ok {
+		b = &bucket{}
+		ipBuckets.m[ip] = b
+	}
+	return b.reserve(now, conf.IPFloodBurst, conf.IPFloodRate)
+}
+
+// floodCheck is called for every line s sends, chat or command. A caller
+// over the limit is slowed down to it; one who keeps going is warned and
+// then gagged. It reports false if the line should be dropped.
+func floodCheck(s *Session) bool {
+	if isCoSysop(s.User) {
+		return true
+	}
+	now := time.Now()
+	wait := s.flood.reserve(now, conf.FloodBurst, conf.FloodRate)
+	if ipWait := reserveIP(remoteIP(s.Conn), now); ipWait > wait {
+		wait = ipWait
+	}
+	if wait == 0 {
+		return true
+	}
+	if now.Before(hub.MutedUntil(s)) {
+		// already gagged: more strikes would only gag them again and
+		// announce it to the whole channel each time
+		return false
+	}
+	if now.Sub(s.flood.lastStrike) > floodCalm {
+		s.flood.strikes = 0
+	}
+	s.flood.strikes++
+	s.flood.lastStrike = now
+	switch {
+	case s.flood.strikes >= floodGagStrikes:
+		s.flood.strikes = 0
+		user, ok := hub.User(s)
+		if !ok {
+			return false
+		}
+		d := time.Duration(conf.FloodGag) * time.Minute
+		hub.Mute(s, now.Add(d))
+		announce(user.Channel, fmt.Sprintf("*#%d:%s was gagged for %d minutes for flooding", user.LineNumber, user.Username, conf.FloodGag))
+		s.log.Info("flood gag", "duration", d)
+		return false
+	case s.flood.strikes == floodWarnStrikes:
+		s.Write([]byte(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, "You are sending too fast. Slow down or you will be gagged."))))
+		s.log.Warn("flood warning")
+	}
+	time.Sleep(wait)
+	// the caller may have been thrown off while they waited
+	return hub.ByLine(s.User.LineNumber) == s
+}
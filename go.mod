@@ -6,3 +6,10 @@ require (
 	github.com/PatrickRudolph/telnet v0.0.0-20210301083732-6a03c1f7971f
 	github.com/mattn/go-sqlite3 v1.14.16
 )
+
+require golang.org/x/crypto v0.24.0
+
+require (
+	golang.org/x/net v0.26.0
+	golang.org/x/sys v0.21.0 // indirect
+)
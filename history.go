@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultHistoryReplay = 10
+
+// retention returns how many lines of scrollback channel keeps: the
+// sysop's setting for it, or historylines from the config.
+func retention(channel int, db *sql.DB) (int, error) {
+	var lines int
+	err := db.QueryRow(`SELECT retention FROM channel_settings WHERE channel = ?`, channel).Scan(&lines)
+	if err == sql.ErrNoRows {
+		return conf.HistoryLines, nil
+	}
+	return lines, err
+}
+
+// recordHistory saves a chat line to its channel's scrollback and trims
+// the channel back to its retention.
+func recordHistory(user User, message string, db *sql.DB) error {
+	keep, err := retention(user.Channel, db)
+	if err != nil {
+		return err
+	}
+	if keep == 0 {
+		return nil
+	}
+	_, err = db.Exec(`INSERT INTO history (channel, line, username, level, message, created) VALUES (?, ?, ?, ?, ?, ?)`,
+		user.Channel, user.LineNumber, user.Username, user.Level, message, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return trimHistory(user.Channel, keep, db)
+}
+
+func trimHistory(channel int, keep int, db *sql.DB) error {
+	_, err := db.Exec(`
+		DELETE FROM history
+		WHERE channel = ? AND id <= (
+			SELECT id FROM history WHERE channel = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+		)
+	`, channel, channel, keep)
+	return err
+}
+
+// showHistory handles "/h [n]", replaying the last n lines of the caller's
+// channel.
+func showHistory(s *Session, args string, db *sql.DB) {
+	n := DefaultHistoryReplay
+	if args = strings.TrimSpace(args); args != "" {
+		var err error
+		n, err = strconv.Atoi(args)
+		if err != nil || n < 1 {
+			s.Write([]byte(fmt.Sprintf("Invalid number of lines: %s\r\n", args)))
+			return
+		}
+	}
+	channel := s.User.Channel
+	rows, err := db.Query(`
+		SELECT line, username, level, message, created FROM (
+			SELECT id, line, username, level, message, created
+			FROM history WHERE channel = ? ORDER BY id DESC LIMIT ?
+		) ORDER BY id
+	`, channel, n)
+	if err != nil {
+		s.log.Error("reading history", "err", err)
+		s.Write([]byte("Error: history is unavailable.\r\n"))
+		return
+	}
+	defer rows.Close()
+	var out strings.Builder
+	for rows.Next() {
+		var line, level int
+		var username, message string
+		var created int64
+		if err := rows.Scan(&line, &username, &level, &message, &created); err != nil {
+			s.log.Error("reading history", "err", err)
+			break
+		}
+		out.WriteString(time.Unix(created, 0).Format("[15:04] "))
+		out.WriteString(formMessage(line, channel, username, message, level))
+	}
+	if out.Len() == 0 {
+		s.Write([]byte(fmt.Sprintf("\r\nNo history on channel %d.\r\n", channel)))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("\r\n->.\r\n    History T%d\r\n    ------------\r\n%s", channel, out.String())))
+}
+
+// setRetention handles the sysop command "/hr channel lines".
+func setRetention(s *Session, args string, db *sql.DB) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		s.Write([]byte("Usage: /hr channel lines\r\n"))
+		return
+	}
+	channel, err := strconv.Atoi(fields[0])
+	if err != nil || channel < 1 || channel > conf.Channels {
+		s.Write([]byte(fmt.Sprintf("Error: invalid channel. Must be a number between 1 and %d.\r\n", conf.Channels)))
+		return
+	}
+	keep, err := strconv.Atoi(fields[1])
+	if err != nil || keep < 0 {
+		s.Write([]byte(fmt.Sprintf("Invalid number of lines: %s\r\n", fields[1])))
+		return
+	}
+	_, err = db.Exec(`INSERT INTO channel_settings (channel, retention) VALUES (?, ?)
+		ON CONFLICT (channel) DO UPDATE SET retention = excluded.retention`, channel, keep)
+	if err == nil {
+		err = trimHistory(channel, keep, db)
+	}
+	if err != nil {
+		s.log.Error("setting retention", "err", err)
+		s.Write([]byte("Error: the setting could not be saved.\r\n"))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("Channel %d now keeps %d lines of history.\r\n", channel, keep)))
+}
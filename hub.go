@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"chatserver/logging"
+)
+
+// Session is one caller sitting on a line: the account they logged in with
+// and the connection they are talking on.
+type Session struct {
+	User User
+	Conn Conn
+
+	// loggedIn is when the caller got their line; it never changes.
+	loggedIn time.Time
+
+	// mutedUntil is set by sysops from other lines; guarded by the hub.
+	mutedUntil time.Time
+
+	// lastInput is when the caller last typed anything, and idleWarned
+	// whether they have been told they are about to be logged off for
+	// idling since then; both guarded by the hub.
+	lastInput  time.Time
+	idleWarned bool
+
+	flood floodState
+
+	// log carries the session's line, user and address into every line
+	// it writes.
+	log *logging.Logger
+
+	writeMu sync.Mutex
+	ansi    bool       // guarded by writeMu
+	editor  lineEditor // guarded by writeMu
+}
+
+// Write sends b to the caller, rendering colour markers for their
+// terminal. Writes from different goroutines (the caller's own loop and
+// broadcasts from other lines) are serialized so their output doesn't
+// interleave mid-line, and whatever the caller is part way through typing
+// is wiped first and redrawn underneath.
+func (s *Session) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	out := render(b, s.ansi)
+	if len(s.editor.buf) > 0 {
+		out = append(s.editor.clear(s.ansi), out...)
+		if !bytes.HasSuffix(out, []byte("\n")) {
+			out = append(out, '\r', '\n')
+		}
+		out = append(out, s.editor.buf...)
+	}
+	if _, err := s.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetANSI turns colour on or off for the session.
+func (s *Session) SetANSI(on bool) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.ansi = on
+}
+
+// ANSI reports whether the session is getting colour.
+func (s *Session) ANSI() bool {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.ansi
+}
+
+// Hub owns every online session and the line numbers they hold. All access
+// to who is online goes through it so handleConnection goroutines never
+// touch shared maps directly.
+type Hub struct {
+	mu       sync.RWMutex
+	taken    map[int]bool
+	sessions map[int]*Session
+	// queue holds callers waiting for a line, first come first served.
+	queue []*Waiter
+}
+
+// Waiter is a caller in the queue for a line. Line receives the line
+// number reserved for them once one frees up.
+type Waiter struct {
+	privileged bool
+	Line       chan int
+}
+
+func newHub() *Hub {
+	return &Hub{
+		taken:    make(map[int]bool),
+		sessions: make(map[int]*Session),
+	}
+}
+
+// ReserveLine claims the lowest free line number, or returns -1 when every
+// line open to the caller is busy. Only privileged callers may take the
+// last conf.ReservedLines lines.
+func (h *Hub) ReserveLine(privileged bool) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.reserve(privileged)
+}
+
+func (h *Hub) reserve(privileged bool) int {
+	limit := conf.MaxLines
+	if !privileged {
+		limit -= conf.ReservedLines
+	}
+	if len(h.taken) >= limit {
+		return -1
+	}
+	for i := 1; i <= conf.MaxLines; i++ {
+		if !h.taken[i] {
+			h.taken[i] = true
+			return i
+		}
+	}
+	return -1
+}
+
+// ReleaseLine frees a line that was reserved but never registered, handing
+// it on to whoever is waiting.
+func (h *Hub) ReleaseLine(line int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[line] == nil {
+		delete(h.taken, line)
+		h.handOff()
+	}
+}
+
+// Wait puts a caller in the queue for a line. It returns nil if the queue
+// is already conf.LineQueue long.
+func (h *Hub) Wait(privileged bool) *Waiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.queue) >= conf.LineQueue {
+		return nil
+	}
+	w := &Waiter{privileged: privileged, Line: make(chan int, 1)}
+	h.queue = append(h.queue, w)
+	return w
+}
+
+// Position returns w's place in the queue, counting from 1, or 0 once it
+// has left.
+func (h *Hub) Position(w *Waiter) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for i, other := range h.queue {
+		if other == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Leave takes w out of the queue. A line already reserved for w is freed
+// again.
+func (h *Hub) Leave(w *Waiter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, other := range h.queue {
+		if other == w {
+			h.queue = append(h.queue[:i], h.queue[i+1:]...)
+			return
+		}
+	}
+	select {
+	case line := <-w.Line:
+		delete(h.taken, line)
+		h.handOff()
+	default:
+	}
+}
+
+// handOff gives free lines to the callers waiting for them, in order,
+// skipping any who can't use the lines that are left. h.mu must be held.
+func (h *Hub) handOff() {
+	for i := 0; i < len(h.queue); {
+		w := h.queue[i]
+		line := h.reserve(w.privileged)
+		if line == -1 {
+			i++
+			continue
+		}
+		w.Line <- line
+		h.queue = append(h.queue[:i], h.queue[i+1:]...)
+	}
+}
+
+// Register puts a session on the line held in s.User.LineNumber. When
+// exclusive is set it reports false, registering nothing, if the account is
+// already online on another line.
+func (h *Hub) Register(s *Session, exclusive bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if exclusive {
+		for _, other := range h.sessions {
+			if other.User.Number == s.User.Number {
+				return false
+			}
+		}
+	}
+	h.taken[s.User.LineNumber] = true
+	h.sessions[s.User.LineNumber] = s
+	s.lastInput = time.Now()
+	return true
+}
+
+// Replace takes every other session logged in to s's account off the hub
+// and registers s, returning the sessions it took off. If s has no line
+// yet it is given the first of theirs, so the line never comes free for
+// someone else to take; if the account wasn't online either, nothing is
+// done and Replace returns nil.
+func (h *Hub) Replace(s *Session) []*Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var old []*Session
+	for _, line := range h.linesLocked() {
+		other := h.sessions[line]
+		if other == s || other.User.Number != s.User.Number {
+			continue
+		}
+		old = append(old, other)
+		delete(h.sessions, line)
+		if s.User.LineNumber == 0 {
+			s.User.LineNumber = line
+		} else {
+			delete(h.taken, line)
+		}
+	}
+	if s.User.LineNumber == 0 {
+		return nil
+	}
+	h.taken[s.User.LineNumber] = true
+	h.sessions[s.User.LineNumber] = s
+	s.lastInput = time.Now()
+	h.handOff()
+	return old
+}
+
+// Unregister drops s and frees its line number. It reports false if s was
+// no longer online, so teardown paths racing each other only run once; a
+// line that has since been handed to someone else is left alone.
+func (h *Hub) Unregister(s *Session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	line := s.User.LineNumber
+	if h.sessions[line] != s {
+		return false
+	}
+	delete(h.sessions, line)
+	delete(h.taken, line)
+	h.handOff()
+	return true
+}
+
+// ByLine returns the session on line, or nil.
+func (h *Hub) ByLine(line int) *Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions[line]
+}
+
+// ByNumber returns every session logged in to account number, ordered by
+// line number.
+func (h *Hub) ByNumber(number int) []*Session {
+	return h.snapshot(func(u User) bool { return u.Number == number })
+}
+
+// User returns a copy of s's account, or false once s is off the hub.
+// A line can pass to another session (see Replace), so sessions are
+// always looked up by themselves rather than by their line number.
+func (h *Hub) User(s *Session) (User, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.sessions[s.User.LineNumber] != s {
+		return User{}, false
+	}
+	return s.User, true
+}
+
+// SetChannel moves s to channel. It reports false once s is off the hub.
+func (h *Hub) SetChannel(s *Session, channel int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[s.User.LineNumber] != s {
+		return false
+	}
+	s.User.Channel = channel
+	return true
+}
+
+// Mute gags s until the given time. A zero time lifts the gag. It reports
+// false once s is off the hub.
+func (h *Hub) Mute(s *Session, until time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[s.User.LineNumber] != s {
+		return false
+	}
+	s.mutedUntil = until
+	return true
+}
+
+// MutedUntil returns when s's gag runs out; it is in the past if s may talk.
+func (h *Hub) MutedUntil(s *Session) time.Time {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return s.mutedUntil
+}
+
+// Touch records that s just typed something.
+func (h *Hub) Touch(s *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.lastInput = time.Now()
+	s.idleWarned = false
+}
+
+// Idle returns how long s has gone without typing anything.
+func (h *Hub) Idle(s *Session) time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return time.Since(s.lastInput)
+}
+
+// WarnIdle marks s as warned about idling. It reports false if s had
+// already been warned since they last typed.
+func (h *Hub) WarnIdle(s *Session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.idleWarned {
+		return false
+	}
+	s.idleWarned = true
+	return true
+}
+
+// Users returns a snapshot of everyone online, ordered by line number.
+func (h *Hub) Users() []User {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var users []User
+	for _, line := range h.linesLocked() {
+		users = append(users, h.sessions[line].User)
+	}
+	return users
+}
+
+// Broadcast sends message to every session in channel.
+func (h *Hub) Broadcast(channel int, message string) {
+	for _, s := range h.snapshot(func(u User) bool { return u.Channel == channel }) {
+		s.Write([]byte(message))
+	}
+}
+
+// SendAll sends message to every session regardless of channel.
+func (h *Hub) SendAll(message string) {
+	for _, s := range h.snapshot(func(User) bool { return true }) {
+		s.Write([]byte(message))
+	}
+}
+
+// snapshot collects the sessions matching keep so the caller can write to
+// them without holding the lock; a slow connection must not stall the hub.
+func (h *Hub) snapshot(keep func(User) bool) []*Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []*Session
+	for _, line := range h.linesLocked() {
+		if s := h.sessions[line]; keep(s.User) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (h *Hub) linesLocked() []int {
+	lines := make([]int, 0, len(h.sessions))
+	for line := range h.sessions {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chatserver/logging"
+)
+
+// fakeConn is a Conn that records what is written to it.
+type fakeConn struct {
+	mu     sync.Mutex
+	out    bytes.Buffer
+	closed bool
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.out.Write(b)
+}
+
+func (c *fakeConn) ReadKey() (byte, error) { return 0, io.EOF }
+func (c *fakeConn) SetEcho(bool)           {}
+func (c *fakeConn) Size() (int, int)       { return 80, 24 }
+func (c *fakeConn) Dumb() bool             { return true }
+func (c *fakeConn) RemoteAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *fakeConn) Secure() bool           { return false }
+func (c *fakeConn) Kind() string           { return "telnet" }
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.String()
+}
+
+// withLines runs the test with the given line settings, putting the
+// defaults back afterwards.
+func withLines(t *testing.T, maxLines, reserved, queue int) {
+	t.Helper()
+	saved, savedLogger := *conf, logger
+	conf.MaxLines, conf.ReservedLines, conf.LineQueue = maxLines, reserved, queue
+	logger = logging.New(io.Discard, logging.LevelError)
+	t.Cleanup(func() {
+		*conf = saved
+		logger = savedLogger
+	})
+}
+
+func newTestSession(line int, number int) *Session {
+	return &Session{
+		User: User{LineNumber: line, Number: number, Username: "user", Channel: 1},
+		Conn: &fakeConn{},
+		log:  logger,
+	}
+}
+
+// register reserves a line and puts a new session for account number on
+// it.
+func register(t *testing.T, h *Hub, number int, privileged bool) *Session {
+	t.Helper()
+	line := h.ReserveLine(privileged)
+	if line == -1 {
+		t.Fatalf("no line free for account %d", number)
+	}
+	s := newTestSession(line, number)
+	if !h.Register(s, false) {
+		t.Fatalf("registering line %d refused", line)
+	}
+	return s
+}
+
+func TestHubConcurrentUse(t *testing.T) {
+	withLines(t, 20, 0, 0)
+	h := newHub()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				line := h.ReserveLine(false)
+				if line == -1 {
+					continue
+				}
+				s := newTestSession(line, i*100+j)
+				h.Register(s, false)
+				h.SetChannel(s, j%4+1)
+				h.Touch(s)
+				h.Broadcast(j%4+1, "hello\r\n")
+				h.SendAll("everyone\r\n")
+				h.Users()
+				h.Idle(s)
+				h.Mute(s, time.Now().Add(time.Minute))
+				if !h.Unregister(s) {
+					t.Errorf("line %d was taken from under its session", line)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(h.taken) != 0 || len(h.sessions) != 0 {
+		t.Fatalf("%d lines still taken and %d sessions left after everyone logged off", len(h.taken), len(h.sessions))
+	}
+	if line := h.ReserveLine(false); line != 1 {
+		t.Fatalf("first line after everyone left is %d, want 1", line)
+	}
+}
+
+func TestBroadcastReachesOnlyChannel(t *testing.T) {
+	withLines(t, 5, 0, 0)
+	h := newHub()
+	a := register(t, h, 1, false)
+	b := register(t, h, 2, false)
+	h.SetChannel(b, 2)
+	h.Broadcast(1, "one\r\n")
+	if !strings.Contains(a.Conn.(*fakeConn).String(), "one") {
+		t.Errorf("channel 1 broadcast missed line %d", a.User.LineNumber)
+	}
+	if strings.Contains(b.Conn.(*fakeConn).String(), "one") {
+		t.Errorf("channel 1 broadcast reached line %d on channel 2", b.User.LineNumber)
+	}
+}
+
+func TestTimedWriteHangsUpStalledPeer(t *testing.T) {
+	saved := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	defer func() { writeTimeout = saved }()
+
+	// nothing ever reads the other end of the pipe, so the write blocks
+	// the way it would once a dead caller's send buffer filled
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- timedWrite(func() error {
+			_, err := server.Write([]byte("hello"))
+			return err
+		}, server.Close)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("stalled write reported success")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled write was never hung up on")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// idleCheckInterval is how often watchIdle looks for idle callers.
+const idleCheckInterval = 5 * time.Second
+
+// idleLimit returns how long a user of level may go without typing, or 0
+// if they may idle forever.
+func idleLimit(level int) time.Duration {
+	return time.Duration(conf.IdleLimit(level)) * time.Minute
+}
+
+// watchIdle warns callers who have stopped typing and logs them off once
+// they pass the idle limit for their level, so nobody holds a line while
+// away from the keyboard.
+func watchIdle() {
+	for range time.Tick(idleCheckInterval) {
+		for _, s := range hub.snapshot(func(User) bool { return true }) {
+			limit := idleLimit(s.User.Level)
+			if limit == 0 {
+				continue
+			}
+			idle := hub.Idle(s)
+			warning := time.Duration(conf.IdleWarning) * time.Second
+			switch {
+			case idle >= limit:
+				user, ok := hub.User(s)
+				if !ok {
+					continue
+				}
+				s.Write([]byte(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, "You have been logged off for being idle."))))
+				s.log.Info("idle logoff", "idle", idle.Round(time.Second))
+				announce(user.Channel, fmt.Sprintf("*#%d:%s was logged off for being idle", user.LineNumber, user.Username))
+				logoff(s)
+			case idle >= limit-warning && hub.WarnIdle(s):
+				left := (limit - idle).Round(time.Second)
+				s.Write([]byte(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, fmt.Sprintf("You will be logged off in %d seconds unless you type something.", int(left.Seconds()))))))
+			}
+		}
+	}
+}
+
+// formatDuration renders an idle or online time for /s.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is a log file that rolls over once it grows past a size limit: the
+// current file becomes name.1, the previous name.1 becomes name.2, and so
+// on, keeping at most keep old files.
+type File struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+// OpenFile opens path for appending, creating it if needed. A maxSize of
+// zero turns rotation off.
+func OpenFile(path string, maxSize int64, keep int) (*File, error) {
+	lf := &File{path: path, maxSize: maxSize, keep: keep}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past its
+// limit.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	if lf.keep < 1 {
+		os.Remove(lf.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", lf.path, lf.keep))
+		for i := lf.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", lf.path, i), fmt.Sprintf("%s.%d", lf.path, i+1))
+		}
+		if err := os.Rename(lf.path, lf.path+".1"); err != nil {
+			return err
+		}
+	}
+	return lf.open()
+}
+
+// Close closes the file.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Close()
+}
@@ -0,0 +1,113 @@
+// Package logging writes the server log: one line per event with a
+// timestamp, a level, a short message and key=value fields, e.g.
+//
+//	2024-05-01 21:04:11.532 INFO  login line=3 user=megalith ip=10.0.0.7
+//
+// Loggers made with With carry their fields into every line they write,
+// so a session can log with its line, user and address attached.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how serious an event is. Lines below a logger's level are
+// dropped.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel reads a level name such as "info", in any case.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// output is shared by a logger and everything derived from it with With.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// Logger writes log lines to an io.Writer. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields string
+}
+
+// New returns a logger writing lines at level and above to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level}}
+}
+
+// With returns a logger that adds the given key, value pairs to every
+// line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	return &Logger{out: l.out, fields: l.fields + formatFields(kv)}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.out.level {
+		return
+	}
+	line := fmt.Sprintf("%s %-5s %s%s%s\n", time.Now().Format("2006-01-02 15:04:05.000"), level, msg, l.fields, formatFields(kv))
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, line)
+}
+
+// formatFields renders key, value pairs as " key=value ...". A key left
+// without a value is shown with the value MISSING.
+func formatFields(kv []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		if i+1 == len(kv) {
+			b.WriteString("MISSING")
+			break
+		}
+		b.WriteString(formatValue(kv[i+1]))
+	}
+	return b.String()
+}
+
+// formatValue quotes a value if it would otherwise be hard to tell where
+// it ends, or could smuggle a fake line into the log.
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"") || strings.IndexFunc(s, func(r rune) bool { return !strconv.IsPrint(r) }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLoginDelay caps the pause after a failed login, however many
+// failures the address has piled up.
+const maxLoginDelay = 30 * time.Second
+
+// loginTimeout is how long a caller has from connecting to getting
+// logged in or finishing an application.
+const loginTimeout = 5 * time.Minute
+
+// failedLoginListSize is how many failed logins /fl shows.
+const failedLoginListSize = 20
+
+// recentFailures counts the failed logins matching where in the last
+// conf.LockoutTime minutes.
+func recentFailures(db *sql.DB, where string, arg interface{}) (int, error) {
+	since := time.Now().Add(-time.Duration(conf.LockoutTime) * time.Minute).Unix()
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM failed_logins WHERE `+where+` AND created > ?`, arg, since).Scan(&count)
+	return count, err
+}
+
+// addressLocked reports whether ip has failed to log in too often lately
+// to be allowed another try.
+func addressLocked(db *sql.DB, ip string) bool {
+	if conf.AddressLockout == 0 {
+		return false
+	}
+	count, err := recentFailures(db, "ip = ?", ip)
+	if err != nil {
+		logger.Error("checking failed logins", "ip", ip, "err", err)
+		return false
+	}
+	return count >= conf.AddressLockout
+}
+
+// accountLocked reports whether account number has had too many wrong
+// passwords lately to accept even the right one.
+func accountLocked(db *sql.DB, number int) bool {
+	if conf.AccountLockout == 0 {
+		return false
+	}
+	count, err := recentFailures(db, "number = ?", number)
+	if err != nil {
+		logger.Error("checking failed logins", "number", number, "err", err)
+		return false
+	}
+	return count >= conf.AccountLockout
+}
+
+// failedLogin records a wrong password for account number, or for no
+// account when number is 0, and returns how long the caller should wait
+// before trying again. The wait doubles with each recent failure from
+// their address, so reconnecting doesn't reset it.
+func failedLogin(db *sql.DB, number int, ip string, via string) time.Duration {
+	var account interface{}
+	if number != 0 {
+		account = number
+	}
+	_, err := db.Exec(`INSERT INTO failed_logins (number, ip, via, created) VALUES (?, ?, ?, ?)`, account, ip, via, time.Now().Unix())
+	if err != nil {
+		logger.Error("saving failed login", "ip", ip, "err", err)
+	}
+	logger.Warn("login failed", "ip", ip, "number", number, "via", via)
+
+	failures, err := recentFailures(db, "ip = ?", ip)
+	if err != nil {
+		logger.Error("checking failed logins", "ip", ip, "err", err)
+		failures = 1
+	}
+	if failures == conf.AddressLockout {
+		logger.Warn("address locked out", "ip", ip)
+	}
+	if number != 0 && conf.AccountLockout > 0 {
+		if count, err := recentFailures(db, "number = ?", number); err == nil && count == conf.AccountLockout {
+			logger.Warn("account locked out", "number", number, "ip", ip)
+		}
+	}
+
+	delay := time.Duration(conf.LoginDelay) * time.Second
+	for i := 1; i < failures && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+	return delay
+}
+
+// reportFailedLogins tells someone who has just logged in how many wrong
+// passwords were tried on their account since they last heard about it.
+func reportFailedLogins(conn io.Writer, number int, db *sql.DB) {
+	var count int
+	var last sql.NullInt64
+	err := db.QueryRow(`SELECT COUNT(*), MAX(created) FROM failed_logins WHERE number = ? AND seen = 0`, number).Scan(&count, &last)
+	if err != nil {
+		logger.Error("checking failed logins", "number", number, "err", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+	attempts := "attempts"
+	if count == 1 {
+		attempts = "attempt"
+	}
+	conn.Write([]byte(fmt.Sprintf("There have been %d failed login %s on your account since you last logged in, the latest at %s.\r\n", count, attempts, time.Unix(last.Int64, 0).Format("01/02 15:04"))))
+	if _, err := db.Exec(`UPDATE failed_logins SET seen = 1 WHERE number = ? AND seen = 0`, number); err != nil {
+		logger.Error("marking failed logins seen", "number", number, "err", err)
+	}
+}
+
+// listFailedLogins handles the sysop command "/fl [number|address]",
+// showing the latest failed logins, all of them or just those for one
+// account or address.
+func listFailedLogins(s *Session, args string, db *sql.DB) {
+	args = strings.TrimSpace(args)
+	query := `SELECT number, ip, via, created FROM failed_logins`
+	var params []interface{}
+	if number, err := strconv.Atoi(args); err == nil {
+		query += ` WHERE number = ?`
+		params = append(params, number)
+	} else if net.ParseIP(args) != nil {
+		query += ` WHERE ip = ?`
+		params = append(params, args)
+	} else if args != "" {
+		s.Write([]byte("Usage: /fl [number|address]\r\n"))
+		return
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	params = append(params, failedLoginListSize)
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		s.log.Error("listing failed logins", "err", err)
+		s.Write([]byte("Error: failed logins are unavailable.\r\n"))
+		return
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var number sql.NullInt64
+		var ip, via string
+		var created int64
+		if err := rows.Scan(&number, &ip, &via, &created); err != nil {
+			s.log.Error("listing failed logins", "err", err)
+			break
+		}
+		account := "-"
+		if number.Valid {
+			account = strconv.FormatInt(number.Int64, 10)
+		}
+		lines = append(lines, fmt.Sprintf("  %s %-8s %-6s %s", time.Unix(created, 0).Format("01/02 15:04"), account, via, ip))
+	}
+	if len(lines) == 0 {
+		s.Write([]byte("\r\nNo failed logins.\r\n"))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("\r\n->.\r\n    Failed logins\r\n    ------------\r\n%s\r\n", strings.Join(lines, "\r\n"))))
+}
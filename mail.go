@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// findAccount looks up an account by user number or handle.
+func findAccount(who string, db *sql.DB) (int, string, error) {
+	var number int
+	var username string
+	var err error
+	if n, convErr := strconv.Atoi(who); convErr == nil {
+		err = db.QueryRow(`SELECT number, username FROM users WHERE number = ?`, n).Scan(&number, &username)
+	} else {
+		err = db.QueryRow(`SELECT number, username FROM users WHERE username = ? COLLATE NOCASE`, who).Scan(&number, &username)
+	}
+	return number, username, err
+}
+
+func unreadMail(number int, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM mail WHERE to_number = ? AND read = 0`, number).Scan(&count)
+	return count, err
+}
+
+func deliverMail(s *Session, toNumber int, toName string, body string, db *sql.DB) {
+	_, err := db.Exec(`INSERT INTO mail (from_number, from_name, to_number, body, created) VALUES (?, ?, ?, ?, ?)`,
+		s.User.Number, s.User.Username, toNumber, body, time.Now().Unix())
+	if err != nil {
+		s.log.Error("saving mail", "err", err)
+		s.Write([]byte("Error: your mail could not be sent.\r\n"))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("Mail sent to %s.\r\n", toName)))
+	for _, user := range hub.Users() {
+		if user.Number == toNumber {
+			if to := hub.ByLine(user.LineNumber); to != nil {
+				to.Write([]byte(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, fmt.Sprintf("You have new mail from %s.", s.User.Username)))))
+			}
+		}
+	}
+}
+
+// sendMail handles "/ms who message", where who is a user number or handle.
+func sendMail(s *Session, args string, db *sql.DB) {
+	split := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(split) < 2 || strings.TrimSpace(split[1]) == "" {
+		s.Write([]byte("Usage: /ms number-or-handle message\r\n"))
+		return
+	}
+	if gagged(s) {
+		return
+	}
+	number, username, err := findAccount(split[0], db)
+	if err == sql.ErrNoRows {
+		s.Write([]byte(fmt.Sprintf("No such user: %s\r\n", split[0])))
+		return
+	}
+	if err != nil {
+		s.log.Error("finding user", "err", err)
+		s.Write([]byte("Error: mail is unavailable.\r\n"))
+		return
+	}
+	deliverMail(s, number, username, strings.TrimSpace(split[1]), db)
+}
+
+// listMail handles "/ml".
+func listMail(s *Session, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, from_name, body, created, read FROM mail WHERE to_number = ? ORDER BY id`, s.User.Number)
+	if err != nil {
+		s.log.Error("listing mail", "err", err)
+		s.Write([]byte("Error: mail is unavailable.\r\n"))
+		return
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var id, read int
+		var from, body string
+		var created int64
+		if err := rows.Scan(&id, &from, &body, &created, &read); err != nil {
+			s.log.Error("listing mail", "err", err)
+			break
+		}
+		flag := " "
+		if read == 0 {
+			flag = "*"
+		}
+		if r := []rune(body); len(r) > 30 {
+			body = string(r[:30]) + "..."
+		}
+		lines = append(lines, fmt.Sprintf("  %s%4d %-14s %s %s", flag, id, from, time.Unix(created, 0).Format("01/02 15:04"), body))
+	}
+	if len(lines) == 0 {
+		s.Write([]byte("\r\nYour mailbox is empty.\r\n"))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("\r\n->.\r\n    Mail (* = new)\r\n    ------------\r\n%s\r\n", strings.Join(lines, "\r\n"))))
+}
+
+// ownMail loads message id from s's mailbox.
+func ownMail(s *Session, args string, db *sql.DB) (id int, fromNumber int, from string, body string, created int64, ok bool) {
+	idStr := strings.Fields(args)
+	if len(idStr) == 0 {
+		s.Write([]byte("Which message? See /ml for the list.\r\n"))
+		return
+	}
+	id, err := strconv.Atoi(idStr[0])
+	if err != nil {
+		s.Write([]byte(fmt.Sprintf("Invalid message number: %s\r\n", idStr[0])))
+		return
+	}
+	err = db.QueryRow(`SELECT from_number, from_name, body, created FROM mail WHERE id = ? AND to_number = ?`, id, s.User.Number).Scan(&fromNumber, &from, &body, &created)
+	if err == sql.ErrNoRows {
+		s.Write([]byte(fmt.Sprintf("You have no message %d.\r\n", id)))
+		return
+	}
+	if err != nil {
+		s.log.Error("reading mail", "err", err)
+		s.Write([]byte("Error: mail is unavailable.\r\n"))
+		return
+	}
+	return id, fromNumber, from, body, created, true
+}
+
+// readMail handles "/mr #".
+func readMail(s *Session, args string, db *sql.DB) {
+	id, _, from, body, created, ok := ownMail(s, args, db)
+	if !ok {
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("\r\n->.\r\n    Mail %d from %s, %s\r\n    %s\r\n", id, from, time.Unix(created, 0).Format("2006-01-02 15:04"), body)))
+	if _, err := db.Exec(`UPDATE mail SET read = 1 WHERE id = ?`, id); err != nil {
+		s.log.Error("marking mail read", "err", err)
+	}
+}
+
+// replyMail handles "/mre # message".
+func replyMail(s *Session, args string, db *sql.DB) {
+	split := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(split) < 2 || strings.TrimSpace(split[1]) == "" {
+		s.Write([]byte("Usage: /mre # message\r\n"))
+		return
+	}
+	_, fromNumber, from, _, _, ok := ownMail(s, split[0], db)
+	if !ok || gagged(s) {
+		return
+	}
+	deliverMail(s, fromNumber, from, strings.TrimSpace(split[1]), db)
+}
+
+// deleteMail handles "/md #".
+func deleteMail(s *Session, args string, db *sql.DB) {
+	id, _, _, _, _, ok := ownMail(s, args, db)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM mail WHERE id = ?`, id); err != nil {
+		s.log.Error("deleting mail", "err", err)
+		s.Write([]byte("Error: the message could not be deleted.\r\n"))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("Message %d deleted.\r\n", id)))
+}
@@ -2,26 +2,30 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
-	"github.com/PatrickRudolph/telnet"
+	"chatserver/auth"
+	"chatserver/config"
+	"chatserver/logging"
+	"chatserver/schema"
 )
 
-const (
-	SystemName = "VariDial 1.0"
-	Rodent     = "()"
-	Normal     = "[]"
-	CoSysop    = "<]"
-	SysOp      = "<>"
-)
+const SystemName = "VariDial 1.0"
 
 type User struct {
 	ID         int
@@ -34,76 +38,82 @@ type User struct {
 }
 
 var (
-	clients          map[string]*telnet.Connection
-	takenLineNumbers = make(map[int]bool)
-	lineNumbers      = make(map[string]User)
+	conf   = config.Default()
+	hub    = newHub()
+	logger = logging.New(os.Stdout, logging.LevelInfo)
 )
 
 func broadcastMessage(message string, sender User) {
-	for username, conn := range clients {
-		if user, ok := lineNumbers[username]; ok && user.Channel == sender.Channel {
-			conn.Write([]byte(message + "\r\n"))
+	hub.Broadcast(sender.Channel, message+"\r\n")
+}
+
+// errLineTooLong is returned by readLine for a line over its limit.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line of up to max bytes at the login prompts, where the
+// caller's client does the echo and editing and only backspace needs
+// handling here. Once the caller is logged in their Session's line editor
+// takes over. A caller who goes over max is told so and gets
+// errLineTooLong, so nobody can make the server hold an endless line.
+func readLine(conn Conn, max int) (string, error) {
+	var line []byte
+	for {
+		ch, err := conn.ReadKey()
+		if err != nil {
+			return "", err
+		}
+		switch ch {
+		case '\r':
+			return strings.TrimSpace(string(line)), nil
+		case '\b', 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		default:
+			if len(line) >= max {
+				conn.Write([]byte("\r\nLine too long.\r\n"))
+				return "", errLineTooLong
+			}
+			line = append(line, ch)
 		}
 	}
 }
 
-func readLine(conn *telnet.Connection) (string, error) {
-	reader := bufio.NewReader(conn)
-	line, _, err := reader.ReadLine()
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(string(line)), nil
+// readPassword reads a line without it showing on the caller's screen.
+func readPassword(conn Conn, max int) (string, error) {
+	conn.SetEcho(true)
+	defer conn.SetEcho(false)
+	return readLine(conn, max)
 }
 func sendAll(message string) {
-	for _, conn := range clients {
-		conn.Write([]byte(message + "\r\n"))
-	}
+	hub.SendAll(message + "\r\n")
 }
 
-/* fix this with the following:
-input := "p12 message stuff"
-
-// Split the input string into two parts, separated by a space
-parts := strings.SplitN(input, " ", 2)
-
-// The first part will be the first character and the number
-firstPart := parts[0]
-
-// The second part will be the rest of the message
-secondPart := parts[1]
-
-// Extract the number from the first part
-number, err := strconv.Atoi(firstPart[1:])
-if err != nil {
-    // Handle the error, for example by logging it
-    fmt.Println("Error converting number:", err)
-}
-
-fmt.Println("Number:", number)
-fmt.Println("Message:", secondPart)
-*/
-
-func processCommand(conn *telnet.Connection, userchannel int, username string, message string, userlevel int, db *sql.DB) {
+func processCommand(conn *Session, message string, db *sql.DB) {
+	username := conn.User.Username
+	userchannel := conn.User.Channel
 	if message[0] == '/' {
 		parts := strings.SplitN(message[1:], " ", 2)
 		command := parts[0]
 		var args string
-		fmt.Println("Command:", command)
 		if len(parts) == 2 {
 			args = parts[1]
 		}
+		// "/p12 hi" is shorthand for "/p 12 hi".
+		if i := strings.IndexAny(command, "0123456789"); i > 0 {
+			args = strings.TrimSpace(command[i:] + " " + args)
+			command = command[:i]
+		}
+		conn.log.Debug("command", "command", command)
+		if modCommands[command] && !isCoSysop(conn.User) || sysopCommands[command] && !isSysop(conn.User) {
+			conn.Write([]byte(fmt.Sprintf("Unknown command: %s\n", command)))
+			return
+		}
 		switch command {
 		case "q":
-			conn.Close()
-			delete(clients, username)
-			sendAll(fmt.Sprintf("\r\n%s left the chat\n", username))
+			logoff(conn)
 		case "s":
-			var usernames []string
-			for username, user := range lineNumbers {
-				usernames = append(usernames, fmt.Sprintf("#%d[T1: %s: \r\n", user.LineNumber, username))
-			}
-			conn.Write([]byte(fmt.Sprintf("\r\n->.\r\n    Online\r\n    ------------\r\n    %s\r\n", strings.Join(usernames, ", "))))
+			listOnline(conn, args)
 		case "p":
 			split := strings.SplitN(args, " ", 2)
 			if len(split) < 2 {
@@ -117,90 +127,277 @@ func processCommand(conn *telnet.Connection, userchannel int, username string, m
 				break
 			}
 			privateMessage := split[1]
-			fmt.Println("Sending private message from", username, "to", toLineNumber, ":", privateMessage)
+			if gagged(conn) {
+				break
+			}
+			transcript(conn, "private message", privateMessage, "to", toLineNumber)
 			sendPrivateMessageByLineNumber(userchannel, username, toLineNumber, privateMessage)
 
 		case "t":
 			channelStr := strings.TrimSpace(args)
-			channel, err := strconv.Atoi(channelStr)
-			if err != nil || channel < 1 || channel > 4 {
-				conn.Write([]byte("Error: invalid channel. Must be a number between 1 and 4.\r\n"))
+			if channelStr == "" {
+				listChannels(conn)
 				break
 			}
-			user, ok := lineNumbers[username]
-			if !ok {
-				conn.Write([]byte("Error: user not found.\r\n"))
+			channel, err := strconv.Atoi(channelStr)
+			if err != nil || channel < 1 || channel > conf.Channels {
+				conn.Write([]byte(fmt.Sprintf("Error: invalid channel. Must be a number between 1 and %d.\r\n", conf.Channels)))
 				break
 			}
-			user.Channel = channel
-			conn.Write([]byte(fmt.Sprintf("Changed to channel %d.\r\n", channel)))
-			updateUser(username, channel, db)
+			changeChannel(conn, channel, db)
+		case "r":
+			requestAccount(conn, remoteIP(conn.Conn), args, db)
+		case "k":
+			kickLine(conn, args)
+		case "f":
+			forceLogoff(conn, args)
+		case "g":
+			gagLine(conn, args)
+		case "ug":
+			ungagLine(conn, args)
+		case "b":
+			banLine(conn, args, false, db)
+		case "bi":
+			banLine(conn, args, true, db)
+		case "h":
+			showHistory(conn, args, db)
+		case "hr":
+			setRetention(conn, args, db)
+		case "ms":
+			sendMail(conn, args, db)
+		case "ml":
+			listMail(conn, db)
+		case "mr":
+			readMail(conn, args, db)
+		case "mre":
+			replyMail(conn, args, db)
+		case "md":
+			deleteMail(conn, args, db)
+		case "a":
+			toggleANSI(conn, args)
+		case "maint":
+			setMaintenance(conn, args)
+		case "fl":
+			listFailedLogins(conn, args, db)
 		case "i":
 			conn.Write([]byte(fmt.Sprintf("\r\n->.\r\n    %s\r\n", SystemName)))
 		case "?":
-			conn.Write([]byte("\r\nCommands:\r\n  /q - Quit\r\n  /s - show online users\r\n  /p # message - Send private message\r\n  /i - system info\r\n  /? - Help\r\n"))
+			conn.Write([]byte("\r\nCommands:\r\n  /q - Quit\r\n  /s [channel] - show online users\r\n  /p # message - Send private message\r\n  /t # - Change channel (/t to list)\r\n  /h [n] - Show the last n lines of the channel\r\n  /ms who message - Mail a user number or handle\r\n  /ml - List your mail\r\n  /mr # - Read mail\r\n  /mre # message - Reply to mail\r\n  /md # - Delete mail\r\n  /r email - Request an account\r\n  /a [on|off] - Toggle ANSI colour\r\n  /i - system info\r\n  /? - Help\r\n"))
+			if isCoSysop(conn.User) {
+				conn.Write([]byte("\r\nSysop commands:\r\n  /k # reason - Kick a line\r\n  /f # - Force a line to log off\r\n  /g # time - Gag a line (minutes, or 2h, 3d)\r\n  /ug # - Ungag a line\r\n  /b # time reason - Ban the account on a line\r\n  /bi # time reason - Ban the address on a line\r\n  /hr channel lines - Set how much history a channel keeps\r\n"))
+			}
+			if isSysop(conn.User) {
+				conn.Write([]byte("  /maint [message|off] - Let only sysops log in\r\n  /fl [number|address] - Show recent failed logins\r\n"))
+			}
 		default:
 			conn.Write([]byte(fmt.Sprintf("Unknown command: %s\n", command)))
 		}
 	}
 }
 
-func updateUser(username string, channel int, db *sql.DB) error {
-	query := `UPDATE users SET channel = ? WHERE number, username = ?,?`
+// logoff is the single teardown path for a session, whether the caller
+// typed /q, dropped carrier, or was thrown off. It frees the line, drops the
+// session from the hub, hangs up and announces the departure to the
+// caller's channel. Calling it again for the same session does nothing.
+func logoff(s *Session) {
+	// logoff may run on another caller's goroutine, so the channel is read
+	// through the hub rather than from s.User, which /t changes
+	user, _ := hub.User(s)
+	if !hub.Unregister(s) {
+		return
+	}
+	s.Conn.Close()
+	s.log.Info("logoff")
+	broadcastMessage(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourLeave, fmt.Sprintf("-#%d:%s", user.LineNumber, user.Username))), user)
+}
+
+// modCommands are only available from CoSysop level up.
+var modCommands = map[string]bool{"k": true, "f": true, "g": true, "ug": true, "b": true, "bi": true, "hr": true}
+
+// sysopCommands are only available from Sysop level up.
+var sysopCommands = map[string]bool{"maint": true, "fl": true}
+
+// gagged tells s if a sysop has gagged them and reports whether they are
+// still silenced.
+func gagged(s *Session) bool {
+	until := hub.MutedUntil(s)
+	if !time.Now().Before(until) {
+		return false
+	}
+	s.Write([]byte(fmt.Sprintf("You are gagged for another %s.\r\n", time.Until(until).Round(time.Second))))
+	return true
+}
+
+// transcript logs what a caller said. Message text only reaches the log
+// when the sysop has turned transcripts on.
+func transcript(s *Session, event string, text string, kv ...interface{}) {
+	if conf.Transcripts {
+		s.log.Info(event, append(kv, "text", text)...)
+	}
+}
+
+// changeChannel moves s to channel, telling both the channel they left and
+// the one they joined, and remembers it for their next login.
+func changeChannel(s *Session, channel int, db *sql.DB) {
+	old := s.User
+	if old.Channel == channel {
+		s.Write([]byte(fmt.Sprintf("You are already on channel %d.\r\n", channel)))
+		return
+	}
+	if !hub.SetChannel(s, channel) {
+		s.Write([]byte("Error: user not found.\r\n"))
+		return
+	}
+	hub.Broadcast(old.Channel, fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourLeave, fmt.Sprintf("-#%d:%s to T%d", old.LineNumber, old.Username, channel))))
+	s.Write([]byte(fmt.Sprintf("Changed to channel %s.\r\n", channelLabel(channel))))
+	hub.Broadcast(channel, fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourJoin, fmt.Sprintf("+#%d:%s from T%d", old.LineNumber, old.Username, old.Channel))))
+	s.log.Info("change channel", "from", old.Channel, "to", channel)
+	if err := updateUser(old.ID, channel, db); err != nil {
+		s.log.Error("saving channel", "err", err)
+	}
+}
+
+func channelLabel(channel int) string {
+	if name := conf.ChannelName(channel); name != "" {
+		return fmt.Sprintf("%d (%s)", channel, name)
+	}
+	return strconv.Itoa(channel)
+}
+
+func listChannels(s *Session) {
+	counts := make(map[int]int)
+	for _, user := range hub.Users() {
+		counts[user.Channel]++
+	}
+	var lines []string
+	for i := 1; i <= conf.Channels; i++ {
+		lines = append(lines, fmt.Sprintf("    T%-2d %-20s %d online", i, conf.ChannelName(i), counts[i]))
+	}
+	s.Write([]byte(fmt.Sprintf("\r\n->.\r\n    Channels\r\n    ------------\r\n%s\r\n", strings.Join(lines, "\r\n"))))
+}
+
+// listOnline handles "/s [channel]", showing everyone online, or just
+// those in one channel, by line number. Co-sysops also see how and where
+// from each caller is connected.
+func listOnline(s *Session, args string) {
+	channel := 0
+	if args = strings.TrimSpace(args); args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 || n > conf.Channels {
+			s.Write([]byte(fmt.Sprintf("Error: invalid channel. Must be a number between 1 and %d.\r\n", conf.Channels)))
+			return
+		}
+		channel = n
+	}
+	sysop := isCoSysop(s.User)
+	header := "    Line Chan Handle             Idle  Online"
+	if sysop {
+		header += "  Via    Secure Address"
+	}
+	rows := []string{header}
+	for _, user := range hub.Users() {
+		if channel != 0 && user.Channel != channel {
+			continue
+		}
+		other := hub.ByLine(user.LineNumber)
+		if other == nil {
+			continue
+		}
+		open, close, ok := conf.Brackets(user.Level)
+		if !ok {
+			open, close = ' ', ' '
+		}
+		handle := fmt.Sprintf("%c%s%c", open, user.Username, close)
+		row := fmt.Sprintf("    #%-3d T%-3d %s %6s %7s", user.LineNumber, user.Channel,
+			paint(levelColour(user.Level), fmt.Sprintf("%-16s", handle)),
+			formatDuration(hub.Idle(other)), formatDuration(time.Since(other.loggedIn)))
+		if sysop {
+			secure := "no"
+			if other.Conn.Secure() {
+				secure = "yes"
+			}
+			row += fmt.Sprintf("  %-6s %-6s %s", other.Conn.Kind(), secure, remoteIP(other.Conn))
+		}
+		rows = append(rows, row)
+	}
+	title := "Online"
+	if channel != 0 {
+		title = fmt.Sprintf("Online in T%d", channel)
+		if name := conf.ChannelName(channel); name != "" {
+			title += " " + name
+		}
+	}
+	if len(rows) == 1 {
+		s.Write([]byte(fmt.Sprintf("\r\nNobody is on T%d.\r\n", channel)))
+		return
+	}
+	s.Write([]byte(fmt.Sprintf("\r\n->.\r\n    %s\r\n    ------------\r\n%s\r\n", title, strings.Join(rows, "\r\n"))))
+}
+
+func updateUser(id int, channel int, db *sql.DB) error {
+	query := `UPDATE users SET channel = ? WHERE id = ?`
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(channel, username)
+	_, err = stmt.Exec(channel, id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func login(number int, password string, db *sql.DB) *User {
+// loadAccount reads the account with the given user number, along with
+// its stored password.
+func loadAccount(number int, db *sql.DB) (*User, string, error) {
 	var user User
-	err := db.QueryRow(`SELECT username, number, level FROM users WHERE number = ? AND password = ?`, number, password).Scan(&user.Username, &user.Number, &user.Level)
+	var stored string
+	err := db.QueryRow(`SELECT id, username, number, level, channel, password FROM users WHERE number = ?`, number).Scan(&user.ID, &user.Username, &user.Number, &user.Level, &user.Channel, &stored)
 	if err != nil {
-		return nil
+		return nil, "", err
+	}
+	if user.Channel < 1 || user.Channel > conf.Channels {
+		user.Channel = 1
 	}
-	user.Channel = 1
-	return &user
+	return &user, stored, nil
 }
 
-func sendPrivateMessageByLineNumber(fromChannel int, fromUsername string, toLineNumber int, message string) {
-	toUsername := getUsernameByLineNumber(toLineNumber)
-	if toUsername == "" {
-		return
+func login(number int, password string, db *sql.DB) *User {
+	user, stored, err := loadAccount(number, db)
+	if err != nil {
+		auth.CheckPassword(auth.DummyHash, password)
+		return nil
 	}
-	toConn, ok := clients[toUsername]
-	if !ok {
-		return
+	if !auth.CheckPassword(stored, password) {
+		return nil
 	}
-	toConn.Write([]byte(fmt.Sprintf("\r\nP[T%d:%s] ( %s )\r\n", fromChannel, fromUsername, message)))
-}
-
-func getUsernameByLineNumber(toLineNumber int) string {
-	for username, user := range lineNumbers {
-		if user.LineNumber == toLineNumber {
-			return username
+	if !auth.IsHashed(stored) {
+		// Accounts created before passwords were hashed are upgraded the
+		// first time their owner logs in.
+		if hash, err := auth.HashPassword(password); err == nil {
+			if _, err := db.Exec(`UPDATE users SET password = ? WHERE id = ?`, hash, user.ID); err != nil {
+				logger.Error("upgrading password", "number", user.Number, "err", err)
+			}
 		}
 	}
-	return ""
+	return user
 }
 
-func getNextAvailableLineNumber() int {
-	for i := 1; i <= 99; i++ {
-		if !takenLineNumbers[i] {
-			takenLineNumbers[i] = true
-			return i
-		}
+func sendPrivateMessageByLineNumber(fromChannel int, fromUsername string, toLineNumber int, message string) {
+	// by line, not handle, since a sysop may be on more than one line
+	toConn := hub.ByLine(toLineNumber)
+	if toConn == nil {
+		return
 	}
-	return -1
+	toConn.Write([]byte(fmt.Sprintf("\r\n%s\r\n", paint(colourPrivate, fmt.Sprintf("P[T%d:%s] ( %s )", fromChannel, fromUsername, message)))))
+}
+
+func getNextAvailableLineNumber(privileged bool) int {
+	return hub.ReserveLine(privileged)
 }
 
-func showFile(conn *telnet.Connection, filename string) {
+func showFile(conn Conn, filename string) {
 	file, err := os.Open(filename)
 	if err != nil {
 		conn.Write([]byte(fmt.Sprintf("Error opening file: %s\r\n", filename)))
@@ -218,88 +415,356 @@ func showFile(conn *telnet.Connection, filename string) {
 }
 
 func formMessage(line int, channel int, uname string, message string, ulevel int) string {
-	if ulevel == 0 {
-		return fmt.Sprintf("#%d(T%d:%s ): %s\r\n", line, channel, uname, message)
-	} else if ulevel == 1 {
-		return fmt.Sprintf("#%d[T%d:%s ): %s\r\n", line, channel, uname, message)
-	} else if ulevel == 2 {
-		return fmt.Sprintf("#%d<T%d:%s ): %s\r\n", line, channel, uname, message)
-	} else if ulevel == 3 {
-		return fmt.Sprintf("#%d<T%d:%s ]: %s\r\n", line, channel, uname, message)
-	} else if ulevel == 4 {
-		return fmt.Sprintf("#%d<T%d:%s >: %s\r\n", line, channel, uname, message)
-	}
-	return ("Error: No user Level")
+	open, close, ok := conf.Brackets(ulevel)
+	if !ok {
+		return ("Error: No user Level")
+	}
+	colour := levelColour(ulevel)
+	return fmt.Sprintf("%s%s%s: %s\r\n",
+		paint(colour, fmt.Sprintf("#%d%cT%d:", line, open, channel)),
+		paint(handleColour(ulevel), uname),
+		paint(colour, fmt.Sprintf(" %c", close)),
+		message)
 }
 
-func handleConnection(conn *telnet.Connection, db *sql.DB) {
-	showFile(conn, "login.txt")
-	conn.Write([]byte(SystemName + "\r\n"))
-	conn.Write([]byte("Enter your number: "))
-	numberStr, err := readLine(conn)
+// handleConnection takes a caller from the login prompts into the chat.
+// The telnet and web listeners start here; SSH callers are authenticated
+// during the handshake and go straight to enterChat.
+func handleConnection(conn Conn, db *sql.DB) {
+	defer trackCall(conn)()
+	log := logger.With("ip", remoteIP(conn))
+	log.Debug("connect")
+	ban, err := addressBan(db, remoteIP(conn))
 	if err != nil {
+		log.Error("checking bans", "err", err)
+	}
+	if ban != nil {
+		log.Info("refused banned address")
+		conn.Write([]byte(banMessage(ban)))
 		conn.Close()
 		return
 	}
-	number, err := strconv.Atoi(numberStr)
-	if err != nil {
+	if addressLocked(db, remoteIP(conn)) {
+		log.Info("refused locked-out address")
+		conn.Write([]byte("\r\nToo many failed logins from your address. Please try again later.\r\n"))
 		conn.Close()
 		return
 	}
-	conn.Write([]byte("\r\nEnter your password: "))
-	password, err := readLine(conn)
+	// nobody may sit at the prompts for ever holding a connection open
+	timer := time.AfterFunc(loginTimeout, func() {
+		log.Info("login timed out")
+		conn.Write([]byte("\r\nTimed out. Goodbye!\r\n"))
+		conn.Close()
+	})
+	defer timer.Stop()
+	showFile(conn, "login.txt")
+	conn.Write([]byte(SystemName + "\r\n"))
+	for try := 1; ; try++ {
+		var numberStr string
+		for {
+			conn.Write([]byte("Enter your number: "))
+			numberStr, err = readLine(conn, conf.LineLength)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if numberStr != "/r" && !strings.HasPrefix(numberStr, "/r ") {
+				break
+			}
+			requestAccount(conn, remoteIP(conn), strings.TrimPrefix(numberStr, "/r"), db)
+			conn.Write([]byte("\r\n"))
+		}
+		if numberStr == "" {
+			apply(conn, db)
+			conn.Close()
+			return
+		}
+		// anything that isn't a number is still asked for a password, so
+		// a wrong guess looks the same whatever was typed
+		number, err := strconv.Atoi(numberStr)
+		if err != nil {
+			number = 0
+		}
+		conn.Write([]byte("\r\nEnter your password: "))
+		password, err := readPassword(conn, conf.LineLength)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if number != 0 && accountLocked(db, number) {
+			log.Info("refused locked-out account", "number", number)
+			conn.Write([]byte("\r\nThis account is locked after too many failed logins. Please try again later.\r\n"))
+			conn.Close()
+			return
+		}
+		if user := login(number, password, db); user != nil {
+			if !timer.Stop() {
+				// timed out just as they got in; the line is closed
+				return
+			}
+			enterChat(conn, user, db)
+			return
+		}
+		delay := failedLogin(db, number, remoteIP(conn), conn.Kind())
+		conn.Write([]byte("\r\nLogin incorrect.\r\n"))
+		if try >= conf.LoginTries || addressLocked(db, remoteIP(conn)) {
+			conn.Close()
+			return
+		}
+		time.Sleep(delay)
+		conn.Write([]byte("\r\n"))
+	}
+}
+
+// enterChat puts a caller who has logged in on a line and runs their
+// session until they leave. Every listener ends up here.
+func enterChat(conn Conn, user *User, db *sql.DB) {
+	log := logger.With("ip", remoteIP(conn), "user", user.Username)
+	ban, err := accountBan(db, user.Number)
 	if err != nil {
+		log.Error("checking bans", "err", err)
+	}
+	if ban != nil {
+		log.Info("refused banned account")
+		conn.Write([]byte(banMessage(ban)))
+		conn.Close()
+		return
+	}
+	if atomic.LoadInt32(&closing) != 0 {
+		conn.Write([]byte("\r\nThe system is shutting down. Please call back later.\r\n"))
 		conn.Close()
 		return
 	}
-	user := login(number, password, db)
-	if user == nil {
+	if message := maintenanceMessage(); message != "" && !isSysop(*user) {
+		log.Info("refused during maintenance")
+		conn.Write([]byte(fmt.Sprintf("\r\n%s\r\n", message)))
 		conn.Close()
 		return
 	}
-	lineNumber := getNextAvailableLineNumber()
-	if lineNumber == -1 {
+	exclusive := conf.DuplicateLogin != "sysops" || !isSysop(*user)
+	replace := exclusive && conf.DuplicateLogin != "refuse"
+	if online := hub.ByNumber(user.Number); exclusive && !replace && len(online) > 0 {
+		log.Info("refused, already online", "line", online[0].User.LineNumber)
+		conn.Write([]byte(fmt.Sprintf("\r\nYou are already logged in on line #%d.\r\n", online[0].User.LineNumber)))
 		conn.Close()
 		return
 	}
-	conn.Write([]byte("\r\n/? for help\r\n"))
+	session := &Session{
+		User:     *user,
+		Conn:     conn,
+		loggedIn: time.Now(),
+		ansi:     conf.ANSIEnabled && !conn.Dumb(),
+	}
+	var replaced []*Session
+	if replace {
+		// an old session's line passes straight to this one, so nobody
+		// waiting for a line can take it in between
+		replaced = hub.Replace(session)
+	}
+	if len(replaced) == 0 {
+		privileged := isCoSysop(*user)
+		lineNumber := getNextAvailableLineNumber(privileged)
+		if lineNumber == -1 {
+			lineNumber = waitForLine(conn, privileged, log)
+			if lineNumber == -1 {
+				return
+			}
+		}
+		session.User.LineNumber = lineNumber
+		if replace {
+			// takes off any login to the account that got on meanwhile
+			replaced = hub.Replace(session)
+		} else if !hub.Register(session, exclusive) {
+			// another login to the same account got in first
+			hub.ReleaseLine(lineNumber)
+			log.Info("refused, already online")
+			conn.Write([]byte("\r\nYou are already logged in on another line.\r\n"))
+			conn.Close()
+			return
+		}
+	}
+	lineNumber := session.User.LineNumber
 	user.LineNumber = lineNumber
-	clients[user.Username] = conn
-	lineNumbers[user.Username] = *user
-	broadcastMessage(fmt.Sprintf("\r\n->\r\n +#%d:%s\r\n", lineNumber, user.Username), *user)
+	session.log = logger.With("line", lineNumber, "user", user.Username, "ip", remoteIP(conn))
+	for _, old := range replaced {
+		// old is off the hub already, so its own logoff will do nothing
+		old.Write([]byte(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, "*** You have logged in from another connection. Goodbye!"))))
+		old.Conn.Close()
+		old.log.Info("logoff", "replaced by", remoteIP(conn))
+		broadcastMessage(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourLeave, fmt.Sprintf("-#%d:%s", old.User.LineNumber, old.User.Username))), old.User)
+	}
+	session.Write([]byte("\r\n/? for help\r\n"))
+	if count, err := unreadMail(user.Number, db); err != nil {
+		log.Error("checking mail", "err", err)
+	} else if count > 0 {
+		session.Write([]byte(fmt.Sprintf("You have %d new messages. Type /ml to list them.\r\n", count)))
+	}
+	reportFailedLogins(session, user.Number, db)
+	session.log.Info("login", "number", user.Number, "secure", conn.Secure())
+	defer logoff(session)
+	// From here on the server echoes and edits the caller's input itself.
+	conn.SetEcho(true)
+	broadcastMessage(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourJoin, fmt.Sprintf("+#%d:%s", lineNumber, user.Username))), *user)
 	for {
-		message, err := readLine(conn)
+		message, err := session.ReadLine()
 		if err != nil {
 			break
 		}
+		message = sanitize(strings.TrimSpace(message))
+		if !floodCheck(session) {
+			continue
+		}
 		if len(message) > 0 && message[0] == '/' {
-			processCommand(conn, user.Channel, user.Username, message, user.Level, db)
-		} else {
-			sendAllMessage := formMessage(lineNumber, user.Channel, user.Username, message, user.Level)
-			broadcastMessage(sendAllMessage, *user)
+			processCommand(session, message, db)
+		} else if !gagged(session) {
+			sendAllMessage := formMessage(lineNumber, session.User.Channel, user.Username, message, user.Level)
+			broadcastMessage(sendAllMessage, session.User)
+			transcript(session, "chat", message, "channel", session.User.Channel)
+			if err := recordHistory(session.User, message, db); err != nil {
+				session.log.Error("saving history", "err", err)
+			}
 		}
 	}
 }
 
 func main() {
-	db, err := sql.Open("sqlite3", "./users.db")
+	configFile := flag.String("config", "varidial.conf", "path to the server configuration file")
+	flag.Parse()
+	if err := run(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run starts the server and blocks until it has shut down. An error means
+// it couldn't start; main turns that into a failed exit status so service
+// managers notice.
+func run(configFile string) error {
+	var err error
+	conf, err = config.Load(configFile)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+	level, err := logging.ParseLevel(conf.LogLevel)
+	if err != nil {
+		return err
+	}
+	if conf.LogFile != "" {
+		logFile, err := logging.OpenFile(conf.LogFile, int64(conf.LogSize)<<20, conf.LogKeep)
+		if err != nil {
+			logger.Error("opening log file", "err", err)
+			return fmt.Errorf("opening log file: %v", err)
+		}
+		defer logFile.Close()
+		logger = logging.New(logFile, level)
+	} else {
+		logger = logging.New(os.Stdout, level)
+	}
+	db, err := sql.Open("sqlite3", conf.Database)
+	if err != nil {
+		logger.Error("opening database", "err", err)
+		return fmt.Errorf("opening database: %v", err)
 	}
 	defer db.Close()
-	clients = make(map[string]*telnet.Connection)
-	ln, err := net.Listen("tcp", ":8080")
+	if err := schema.Migrate(db); err != nil {
+		logger.Error("migrating database", "err", err)
+		return fmt.Errorf("migrating database: %v", err)
+	}
+	// Signals are caught from the start so one arriving while the
+	// listeners come up still gets a clean shutdown.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	ln, err := net.Listen("tcp", conf.Addr())
 	if err != nil {
-		panic(err)
+		logger.Error("starting telnet listener", "err", err)
+		return fmt.Errorf("starting telnet listener: %v", err)
 	}
-	defer ln.Close()
-	fmt.Println("Chat server started on port 8080")
+	listeners = append(listeners, ln)
+	go serveTelnet(ln, db)
+	logger.Info("listening", "listener", "telnet", "addr", conf.Addr())
+	if conf.TLSPort != 0 {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			logger.Error("loading TLS certificate", "err", err)
+			return fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		tlsLn, err := tls.Listen("tcp", conf.TLSAddr(), &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			logger.Error("starting TLS listener", "err", err)
+			return fmt.Errorf("starting TLS listener: %v", err)
+		}
+		listeners = append(listeners, tlsLn)
+		go serveTelnet(tlsLn, db)
+		logger.Info("listening", "listener", "tls", "addr", conf.TLSAddr())
+	}
+	if conf.SSHPort != 0 {
+		hostKey, err := loadHostKey(conf.SSHHostKey)
+		if err != nil {
+			logger.Error("loading SSH host key", "err", err)
+			return fmt.Errorf("loading SSH host key: %v", err)
+		}
+		sshLn, err := net.Listen("tcp", conf.SSHAddr())
+		if err != nil {
+			logger.Error("starting SSH listener", "err", err)
+			return fmt.Errorf("starting SSH listener: %v", err)
+		}
+		listeners = append(listeners, sshLn)
+		go serveSSH(sshLn, sshConfig(hostKey, db), db)
+		logger.Info("listening", "listener", "ssh", "addr", conf.SSHAddr())
+	}
+	if conf.WebPort != 0 {
+		webLn, err := net.Listen("tcp", conf.WebAddr())
+		if err != nil {
+			logger.Error("starting web gateway", "err", err)
+			return fmt.Errorf("starting web gateway: %v", err)
+		}
+		listeners = append(listeners, webLn)
+		go serveWeb(webLn, db)
+		logger.Info("listening", "listener", "web", "addr", conf.WebAddr())
+	}
+	go watchIdle()
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig)
+	for _, l := range listeners {
+		l.Close()
+	}
+	shutdown(signals, db)
+	logger.Info("stopped")
+	return nil
+}
+
+// serveTelnet accepts telnet callers on ln, plain or TLS, until it is
+// closed.
+func serveTelnet(ln net.Listener, db *sql.DB) {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			panic(err)
+			logger.Error("accepting connection", "err", err)
+			return
 		}
-		go handleConnection(telnet.NewConnection(conn, []telnet.Option{}), db)
+		go func() {
+			// the handshake and telnet negotiation run here rather than
+			// on the accept loop, so a caller who connects and goes
+			// quiet can't hold up everyone behind them
+			if tc, ok := conn.(*tls.Conn); ok {
+				tc.SetDeadline(time.Now().Add(time.Minute))
+				if err := tc.Handshake(); err != nil {
+					logger.Debug("TLS handshake failed", "ip", hostOf(conn.RemoteAddr()), "err", err)
+					tc.Close()
+					return
+				}
+				tc.SetDeadline(time.Time{})
+			}
+			handleConnection(newTerminal(conn), db)
+		}()
 	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownMarks are the seconds-remaining points at which the shutdown
+// notice is repeated.
+var shutdownMarks = []int{60, 30, 10, 5}
+
+// closing is set once shutdown has begun, so callers still at the login
+// prompts aren't let in.
+var closing int32
+
+// calls holds every connection from the moment it is accepted until the
+// caller hangs up, so shutdown can reach those who aren't on a line yet.
+// Telnet and web callers are held by their Conn; SSH connections by the
+// network connection, as nothing can be shown to them before the
+// handshake.
+var calls = struct {
+	sync.Mutex
+	open map[io.Closer]bool
+}{open: make(map[io.Closer]bool)}
+
+// trackCall adds c to calls and returns the func that takes it out again.
+func trackCall(c io.Closer) func() {
+	calls.Lock()
+	calls.open[c] = true
+	calls.Unlock()
+	return func() {
+		calls.Lock()
+		delete(calls.open, c)
+		calls.Unlock()
+	}
+}
+
+// maintenance is the sysop's maintenance mode: while it is on, only
+// sysops may log in.
+var maintenance struct {
+	sync.Mutex
+	on      bool
+	message string
+}
+
+func isSysop(user User) bool {
+	return user.Level >= conf.SysopLevel
+}
+
+// maintenanceMessage returns the message to refuse a login with, or "" if
+// maintenance mode is off.
+func maintenanceMessage() string {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if !maintenance.on {
+		return ""
+	}
+	return maintenance.message
+}
+
+// setMaintenance handles the sysop command "/maint [message|off]". With
+// no arguments it reports whether maintenance mode is on.
+func setMaintenance(s *Session, args string) {
+	args = strings.TrimSpace(args)
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	switch {
+	case args == "":
+		if maintenance.on {
+			s.Write([]byte(fmt.Sprintf("Maintenance mode is on: %s\r\n", maintenance.message)))
+		} else {
+			s.Write([]byte("Maintenance mode is off.\r\n"))
+		}
+	case strings.EqualFold(args, "off"):
+		maintenance.on = false
+		s.log.Info("maintenance off")
+		s.Write([]byte("Maintenance mode off. Everyone may log in again.\r\n"))
+	default:
+		if strings.EqualFold(args, "on") {
+			args = "The system is down for maintenance. Please try again later."
+		}
+		maintenance.on = true
+		maintenance.message = args
+		s.log.Info("maintenance on", "message", args)
+		s.Write([]byte("Maintenance mode on. Only sysops may log in.\r\n"))
+	}
+}
+
+// shutdown warns everyone online and counts down conf.ShutdownDelay
+// seconds, cut short if another signal arrives. It then saves each
+// caller's channel and hangs up on them, and on everyone still logging
+// in, applying or waiting for a line.
+func shutdown(signals <-chan os.Signal, db *sql.DB) {
+	atomic.StoreInt32(&closing, 1)
+	remaining := conf.ShutdownDelay
+	for remaining > 0 {
+		hub.SendAll(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, fmt.Sprintf("*** %s (%d seconds)", conf.ShutdownNotice, remaining))))
+		next := 0
+		for _, mark := range shutdownMarks {
+			if mark < remaining {
+				next = mark
+				break
+			}
+		}
+		select {
+		case <-time.After(time.Duration(remaining-next) * time.Second):
+			remaining = next
+		case <-signals:
+			logger.Info("shutting down now")
+			remaining = 0
+		}
+	}
+	for _, s := range hub.snapshot(func(User) bool { return true }) {
+		if user, ok := hub.User(s); ok {
+			if err := updateUser(user.ID, user.Channel, db); err != nil {
+				s.log.Error("saving channel", "err", err)
+			}
+		}
+		s.Write([]byte(fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, "*** The system is going down now. Goodbye!"))))
+		if hub.Unregister(s) {
+			s.Conn.Close()
+			s.log.Info("logoff")
+		}
+	}
+	calls.Lock()
+	defer calls.Unlock()
+	for c := range calls.open {
+		// writing to a session closed above just fails
+		if conn, ok := c.(Conn); ok {
+			conn.Write([]byte("\r\n*** The system is going down now. Goodbye!\r\n"))
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ban is an active ban on an account or an address.
+type Ban struct {
+	Reason   string
+	BannedBy string
+	Expires  time.Time
+}
+
+func isCoSysop(user User) bool {
+	return user.Level >= conf.CoSysopLevel
+}
+
+// parseDuration reads a moderation time span. A bare number is minutes;
+// otherwise Go duration syntax is accepted, plus "d" for days.
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return 0, fmt.Errorf("duration must be positive")
+		}
+		return time.Duration(n) * time.Minute, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return d, nil
+}
+
+// moderationTarget reads the line number at the front of args and checks
+// that s may act on whoever is sitting there. It returns the target and
+// the rest of the arguments.
+func moderationTarget(s *Session, args string) (*Session, User, string, bool) {
+	split := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	line, err := strconv.Atoi(split[0])
+	if err != nil {
+		s.Write([]byte(fmt.Sprintf("Invalid line number: %s\r\n", split[0])))
+		return nil, User{}, "", false
+	}
+	var rest string
+	if len(split) == 2 {
+		rest = strings.TrimSpace(split[1])
+	}
+	var user User
+	target := hub.ByLine(line)
+	ok := target != nil
+	if ok {
+		user, ok = hub.User(target)
+	}
+	if !ok {
+		s.Write([]byte(fmt.Sprintf("Nobody is on line %d.\r\n", line)))
+		return nil, User{}, "", false
+	}
+	if target == s {
+		s.Write([]byte("You can't do that to yourself.\r\n"))
+		return nil, User{}, "", false
+	}
+	if user.Level >= s.User.Level {
+		s.Write([]byte(fmt.Sprintf("#%d:%s is not below your level.\r\n", user.LineNumber, user.Username)))
+		return nil, User{}, "", false
+	}
+	return target, user, rest, true
+}
+
+func announce(channel int, message string) {
+	hub.Broadcast(channel, fmt.Sprintf("\r\n->\r\n %s\r\n", paint(colourSystem, message)))
+}
+
+// kickLine handles "/k # reason".
+func kickLine(s *Session, args string) {
+	target, user, reason, ok := moderationTarget(s, args)
+	if !ok {
+		return
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+	announce(user.Channel, fmt.Sprintf("*#%d:%s was kicked by %s (%s)", user.LineNumber, user.Username, s.User.Username, reason))
+	s.log.Info("kick", "target", user.Username, "reason", reason)
+	logoff(target)
+}
+
+// forceLogoff handles "/f #", hanging up a line without a kick notice.
+func forceLogoff(s *Session, args string) {
+	target, user, _, ok := moderationTarget(s, args)
+	if !ok {
+		return
+	}
+	announce(user.Channel, fmt.Sprintf("*#%d:%s was logged off by %s", user.LineNumber, user.Username, s.User.Username))
+	s.log.Info("force logoff", "target", user.Username)
+	logoff(target)
+}
+
+// gagLine handles "/g # time", which stops a line from talking for a while.
+func gagLine(s *Session, args string) {
+	target, user, rest, ok := moderationTarget(s, args)
+	if !ok {
+		return
+	}
+	if rest == "" {
+		rest = "10"
+	}
+	d, err := parseDuration(strings.Fields(rest)[0])
+	if err != nil {
+		s.Write([]byte(fmt.Sprintf("Error: %v\r\n", err)))
+		return
+	}
+	hub.Mute(target, time.Now().Add(d))
+	announce(user.Channel, fmt.Sprintf("*#%d:%s was gagged for %s by %s", user.LineNumber, user.Username, d, s.User.Username))
+	s.log.Info("gag", "target", user.Username, "duration", d)
+}
+
+// ungagLine handles "/ug #".
+func ungagLine(s *Session, args string) {
+	target, user, _, ok := moderationTarget(s, args)
+	if !ok {
+		return
+	}
+	hub.Mute(target, time.Time{})
+	announce(user.Channel, fmt.Sprintf("*#%d:%s was ungagged by %s", user.LineNumber, user.Username, s.User.Username))
+	s.log.Info("ungag", "target", user.Username)
+}
+
+// banLine handles "/b # time reason" and "/bi # time reason", banning the
+// account or the address on a line and throwing it off.
+func banLine(s *Session, args string, byIP bool, db *sql.DB) {
+	target, user, rest, ok := moderationTarget(s, args)
+	if !ok {
+		return
+	}
+	split := strings.SplitN(rest, " ", 2)
+	if split[0] == "" {
+		s.Write([]byte("Usage: /b # time reason\r\n"))
+		return
+	}
+	d, err := parseDuration(split[0])
+	if err != nil {
+		s.Write([]byte(fmt.Sprintf("Error: %v\r\n", err)))
+		return
+	}
+	reason := "no reason given"
+	if len(split) == 2 && strings.TrimSpace(split[1]) != "" {
+		reason = strings.TrimSpace(split[1])
+	}
+	expires := time.Now().Add(d)
+	what := "account"
+	if byIP {
+		what = "address"
+		_, err = db.Exec(`INSERT INTO bans (ip, reason, banned_by, created, expires) VALUES (?, ?, ?, ?, ?)`, remoteIP(target.Conn), reason, s.User.Username, time.Now().Unix(), expires.Unix())
+	} else {
+		_, err = db.Exec(`INSERT INTO bans (number, reason, banned_by, created, expires) VALUES (?, ?, ?, ?, ?)`, user.Number, reason, s.User.Username, time.Now().Unix(), expires.Unix())
+	}
+	if err != nil {
+		s.log.Error("saving ban", "err", err)
+		s.Write([]byte("Error: the ban could not be saved.\r\n"))
+		return
+	}
+	announce(user.Channel, fmt.Sprintf("*#%d:%s's %s was banned for %s by %s (%s)", user.LineNumber, user.Username, what, d, s.User.Username, reason))
+	s.log.Info("ban", "target", user.Username, "what", what, "duration", d, "reason", reason)
+	target.Write([]byte(banMessage(&Ban{Reason: reason, BannedBy: s.User.Username, Expires: expires})))
+	logoff(target)
+}
+
+func banMessage(ban *Ban) string {
+	return fmt.Sprintf("\r\nYou are banned until %s (%s).\r\n", ban.Expires.Format("2006-01-02 15:04"), ban.Reason)
+}
+
+func findBan(db *sql.DB, where string, arg interface{}) (*Ban, error) {
+	var ban Ban
+	var expires int64
+	err := db.QueryRow(`SELECT reason, banned_by, expires FROM bans WHERE `+where+` AND expires > ? ORDER BY expires DESC LIMIT 1`, arg, time.Now().Unix()).Scan(&ban.Reason, &ban.BannedBy, &expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ban.Expires = time.Unix(expires, 0)
+	return &ban, nil
+}
+
+// accountBan returns the active ban on user number, if any.
+func accountBan(db *sql.DB, number int) (*Ban, error) {
+	return findBan(db, "number = ?", number)
+}
+
+// addressBan returns the active ban on ip, if any.
+func addressBan(db *sql.DB, ip string) (*Ban, error) {
+	return findBan(db, "ip = ?", ip)
+}
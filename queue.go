@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"chatserver/logging"
+)
+
+// queueReminder is how often a caller waiting for a line is told where
+// they are in the queue. The write also notices callers who have hung up.
+const queueReminder = 30 * time.Second
+
+const linesBusy = "\r\nAll lines are busy. Please try again later.\r\n"
+
+// waitForLine holds a caller who found every line busy in the queue until
+// a line is reserved for them, and returns it. It returns -1, having hung
+// up on the caller, if the queue is full or turned off or they go away.
+func waitForLine(conn Conn, privileged bool, log *logging.Logger) int {
+	w := hub.Wait(privileged)
+	if w == nil {
+		log.Info("refused, all lines busy")
+		conn.Write([]byte(linesBusy))
+		conn.Close()
+		return -1
+	}
+	log.Info("waiting for a line")
+	ticker := time.NewTicker(queueReminder)
+	defer ticker.Stop()
+	for {
+		// a caller no longer in the queue has a line waiting in w.Line
+		if position := hub.Position(w); position > 0 {
+			if _, err := conn.Write([]byte(fmt.Sprintf("\r\nAll lines are busy. You are number %d in line and will be let in when one frees up. Hang up if you'd rather not wait.\r\n", position))); err != nil {
+				hub.Leave(w)
+				conn.Close()
+				return -1
+			}
+		}
+		select {
+		case line := <-w.Line:
+			if atomic.LoadInt32(&closing) != 0 {
+				hub.ReleaseLine(line)
+				conn.Write([]byte("\r\nThe system is shutting down. Please call back later.\r\n"))
+				conn.Close()
+				return -1
+			}
+			log.Info("line came free", "line", line)
+			conn.Write([]byte("\r\nA line is free. Welcome in!\r\n\a"))
+			return line
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestReservedLines(t *testing.T) {
+	withLines(t, 3, 1, 0)
+	h := newHub()
+	for want := 1; want <= 2; want++ {
+		if line := h.ReserveLine(false); line != want {
+			t.Fatalf("got line %d, want %d", line, want)
+		}
+	}
+	if line := h.ReserveLine(false); line != -1 {
+		t.Fatalf("unprivileged caller got reserved line %d", line)
+	}
+	if line := h.ReserveLine(true); line != 3 {
+		t.Fatalf("privileged caller got line %d, want 3", line)
+	}
+	if line := h.ReserveLine(true); line != -1 {
+		t.Fatalf("got line %d with every line taken", line)
+	}
+}
+
+func TestFreedLinesGoToWaitersInOrder(t *testing.T) {
+	withLines(t, 2, 0, 5)
+	h := newHub()
+	first := register(t, h, 1, false)
+	second := register(t, h, 2, false)
+	w1 := h.Wait(false)
+	w2 := h.Wait(false)
+	if h.Position(w1) != 1 || h.Position(w2) != 2 {
+		t.Fatalf("queue positions %d and %d, want 1 and 2", h.Position(w1), h.Position(w2))
+	}
+	if line := h.ReserveLine(false); line != -1 {
+		t.Fatalf("newcomer got line %d with callers waiting", line)
+	}
+
+	h.Unregister(second)
+	select {
+	case line := <-w1.Line:
+		if line != second.User.LineNumber {
+			t.Fatalf("first waiter got line %d, want %d", line, second.User.LineNumber)
+		}
+	default:
+		t.Fatal("freed line wasn't handed to the first waiter")
+	}
+	if h.Position(w2) != 1 {
+		t.Fatalf("second waiter at position %d, want 1", h.Position(w2))
+	}
+
+	h.Unregister(first)
+	select {
+	case line := <-w2.Line:
+		if line != first.User.LineNumber {
+			t.Fatalf("second waiter got line %d, want %d", line, first.User.LineNumber)
+		}
+	default:
+		t.Fatal("freed line wasn't handed to the second waiter")
+	}
+}
+
+func TestHandOffSkipsWaitersBarredFromReservedLines(t *testing.T) {
+	withLines(t, 2, 1, 5)
+	h := newHub()
+	register(t, h, 1, false)
+	sysop := register(t, h, 2, true)
+	normal := h.Wait(false)
+	privileged := h.Wait(true)
+
+	h.Unregister(sysop)
+	select {
+	case <-normal.Line:
+		t.Fatal("unprivileged waiter was handed a reserved line")
+	default:
+	}
+	select {
+	case line := <-privileged.Line:
+		if line != 2 {
+			t.Fatalf("privileged waiter got line %d, want 2", line)
+		}
+	default:
+		t.Fatal("privileged waiter wasn't handed the reserved line")
+	}
+	if h.Position(normal) != 1 {
+		t.Fatalf("unprivileged waiter at position %d, want 1", h.Position(normal))
+	}
+}
+
+func TestLeaveFreesHandedLine(t *testing.T) {
+	withLines(t, 1, 0, 5)
+	h := newHub()
+	s := register(t, h, 1, false)
+	gone := h.Wait(false)
+	next := h.Wait(false)
+	h.Unregister(s)
+	// the first waiter hung up before taking the line they were given
+	h.Leave(gone)
+	select {
+	case line := <-next.Line:
+		if line != 1 {
+			t.Fatalf("next waiter got line %d, want 1", line)
+		}
+	default:
+		t.Fatal("line left behind by a waiter who hung up wasn't passed on")
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	withLines(t, 1, 0, 1)
+	h := newHub()
+	register(t, h, 1, false)
+	if h.Wait(false) == nil {
+		t.Fatal("first waiter refused")
+	}
+	if h.Wait(false) != nil {
+		t.Fatal("waiter let into a full queue")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// remoteIP returns the host part of the caller's address.
+func remoteIP(conn Conn) string {
+	return hostOf(conn.RemoteAddr())
+}
+
+// hostOf returns the host part of addr.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// requestAccount handles "/r email [note]", from the login prompt or from
+// inside the chat.
+func requestAccount(w io.Writer, ip string, args string, db *sql.DB) {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if parts[0] == "" {
+		w.Write([]byte("\r\nUsage: /r email@email.com [note]\r\n"))
+		return
+	}
+	addr, err := mail.ParseAddress(parts[0])
+	if err != nil || addr.Address != parts[0] {
+		w.Write([]byte(fmt.Sprintf("\r\n%s is not a valid email address.\r\n", parts[0])))
+		return
+	}
+	var note string
+	if len(parts) == 2 {
+		note = strings.TrimSpace(parts[1])
+	}
+
+	var recent int
+	err = db.QueryRow(`SELECT COUNT(*) FROM account_requests WHERE ip = ? AND created > ?`, ip, time.Now().Add(-time.Hour).Unix()).Scan(&recent)
+	if err != nil {
+		logger.Error("checking account requests", "ip", ip, "err", err)
+		w.Write([]byte("\r\nSorry, account requests are unavailable right now.\r\n"))
+		return
+	}
+	if recent >= conf.RequestLimit {
+		w.Write([]byte("\r\nToo many account requests from your address. Try again later.\r\n"))
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO account_requests (email, ip, note, created) VALUES (?, ?, ?, ?)`, addr.Address, ip, note, time.Now().Unix())
+	if err != nil {
+		logger.Error("saving account request", "ip", ip, "err", err)
+		w.Write([]byte("\r\nSorry, your request could not be saved.\r\n"))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("\r\nAccount request for %s received. Thank you!\r\n", addr.Address)))
+}
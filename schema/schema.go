@@ -0,0 +1,263 @@
+// Package schema brings users.db up to the layout the chat server expects.
+// The server and every utility call Migrate at startup so they all agree on
+// the tables, whichever of them created the database first.
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations run in order, each exactly once per database. Append new
+// ones to the end; never renumber or edit one that has shipped.
+var migrations = []migration{
+	{1, "users", createUsers},
+	{2, "applications", createApplications},
+	{3, "account requests", createAccountRequests},
+	{4, "bans", createBans},
+	{5, "history", createHistory},
+	{6, "mail", createMail},
+	{7, "ssh keys", createSSHKeys},
+	{8, "failed logins", createFailedLogins},
+	{9, "application addresses", addApplicationIP},
+}
+
+// Migrate applies every migration newer than the database's recorded
+// schema version.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			applied INT NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err := apply(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// Version returns the newest migration applied to db, or 0 for a database
+// that has never been migrated.
+func Version(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func apply(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var done int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM schema_version WHERE version = ?`, m.version).Scan(&done)
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version, applied) VALUES (?, ?)`, m.version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumns adds each column that table doesn't already have.
+func addColumns(tx *sql.Tx, table string, columns [][2]string) error {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if have[c[0]] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c[0], c[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createUsers(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			active INT NOT NULL DEFAULT 1,
+			username TEXT NOT NULL,
+			number INT NOT NULL,
+			password TEXT NOT NULL,
+			level INT NOT NULL,
+			channel INT NOT NULL DEFAULT 1
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	// Before migrations, initchat created users without "active" and
+	// usermod created it without "channel".
+	return addColumns(tx, "users", [][2]string{
+		{"active", "INT NOT NULL DEFAULT 1"},
+		{"channel", "INT NOT NULL DEFAULT 1"},
+	})
+}
+
+func createApplications(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS applications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			password TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS application_answers (
+			application_id INT NOT NULL,
+			question TEXT NOT NULL,
+			answer TEXT NOT NULL
+		)
+	`)
+	return err
+}
+
+// addApplicationIP records where each application came from, so callers
+// can be limited in how many they file.
+func addApplicationIP(tx *sql.Tx) error {
+	return addColumns(tx, "applications", [][2]string{
+		{"ip", "TEXT NOT NULL DEFAULT ''"},
+	})
+}
+
+func createAccountRequests(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS account_requests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			note TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			created INT NOT NULL
+		)
+	`)
+	return err
+}
+
+func createBans(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS bans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			number INT,
+			ip TEXT,
+			reason TEXT NOT NULL,
+			banned_by TEXT NOT NULL,
+			created INT NOT NULL,
+			expires INT NOT NULL
+		)
+	`)
+	return err
+}
+
+func createHistory(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel INT NOT NULL,
+			line INT NOT NULL,
+			username TEXT NOT NULL,
+			level INT NOT NULL,
+			message TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS history_channel ON history (channel, id);
+		CREATE TABLE IF NOT EXISTS channel_settings (
+			channel INTEGER PRIMARY KEY,
+			retention INT NOT NULL
+		)
+	`)
+	return err
+}
+
+func createMail(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS mail (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_number INT NOT NULL,
+			from_name TEXT NOT NULL,
+			to_number INT NOT NULL,
+			body TEXT NOT NULL,
+			created INT NOT NULL,
+			read INT NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS mail_to ON mail (to_number, id)
+	`)
+	return err
+}
+
+func createSSHKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS ssh_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			number INT NOT NULL,
+			key TEXT NOT NULL,
+			comment TEXT NOT NULL DEFAULT '',
+			added INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS ssh_keys_number ON ssh_keys (number)
+	`)
+	return err
+}
+
+// failed_logins records every bad password. number is NULL when what was
+// typed at the prompt didn't name an account; seen is set once the
+// account's owner has been told about the attempt.
+func createFailedLogins(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS failed_logins (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			number INT,
+			ip TEXT NOT NULL,
+			via TEXT NOT NULL,
+			created INT NOT NULL,
+			seen INT NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS failed_logins_number ON failed_logins (number, created);
+		CREATE INDEX IF NOT EXISTS failed_logins_ip ON failed_logins (ip, created)
+	`)
+	return err
+}
@@ -0,0 +1,212 @@
+package schema
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type userRow struct {
+	id       int
+	active   int
+	username string
+	number   int
+	password string
+	level    int
+	channel  int
+}
+
+// oldLayouts are the users tables that existed before migrations, with the
+// rows an existing install might hold. Columns a layout lacks are expected
+// to come out as 1.
+var oldLayouts = []struct {
+	name   string
+	create string
+	insert string
+	want   []userRow
+}{
+	{
+		name: "sqlite_schema.sql",
+		create: `CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			active INT NOT NULL,
+			username TEXT NOT NULL,
+			number INT NOT NULL,
+			password TEXT NOT NULL,
+			level INT NOT NULL,
+			channel INT NOT NULL
+		)`,
+		insert: `INSERT INTO users (active, username, number, password, level, channel) VALUES
+			(1, 'sysop', 1, 'secret', 3, 2),
+			(0, 'gone', 7, 'hunter2', 1, 1)`,
+		want: []userRow{
+			{1, 1, "sysop", 1, "secret", 3, 2},
+			{2, 0, "gone", 7, "hunter2", 1, 1},
+		},
+	},
+	{
+		name: "initchat",
+		create: `CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username VARCHAR(14) NOT NULL,
+			number INTEGER NOT NULL,
+			password VARCHAR(13) NOT NULL,
+			level INTEGER NOT NULL,
+			channel INTEGER NOT NULL
+		)`,
+		insert: `INSERT INTO users (username, number, password, level, channel) VALUES
+			('sysop', 1, 'secret', 3, 1),
+			('bob', 123, 'password1', 1, 4)`,
+		want: []userRow{
+			{1, 1, "sysop", 1, "secret", 3, 1},
+			{2, 1, "bob", 123, "password1", 1, 4},
+		},
+	},
+	{
+		name: "usermod",
+		create: `CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			active INT NOT NULL,
+			username TEXT NOT NULL,
+			number INT NOT NULL,
+			password TEXT NOT NULL,
+			level INT NOT NULL
+		)`,
+		insert: `INSERT INTO users (active, username, number, password, level) VALUES
+			(1, 'sysop', 1, 'secret', 3),
+			(0, 'gone', 7, 'hunter2', 1)`,
+		want: []userRow{
+			{1, 1, "sysop", 1, "secret", 3, 1},
+			{2, 0, "gone", 7, "hunter2", 1, 1},
+		},
+	},
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func users(t *testing.T, db *sql.DB) []userRow {
+	t.Helper()
+	rows, err := db.Query(`SELECT id, active, username, number, password, level, channel FROM users ORDER BY id`)
+	if err != nil {
+		t.Fatalf("reading users: %v", err)
+	}
+	defer rows.Close()
+	var out []userRow
+	for rows.Next() {
+		var u userRow
+		if err := rows.Scan(&u.id, &u.active, &u.username, &u.number, &u.password, &u.level, &u.channel); err != nil {
+			t.Fatalf("reading users: %v", err)
+		}
+		out = append(out, u)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("reading users: %v", err)
+	}
+	return out
+}
+
+// layout returns the SQL of every table and index in db, so two
+// snapshots can be compared.
+func layout(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name, sql FROM sqlite_master WHERE sql IS NOT NULL ORDER BY name`)
+	if err != nil {
+		t.Fatalf("reading layout: %v", err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var name, sql string
+		if err := rows.Scan(&name, &sql); err != nil {
+			t.Fatalf("reading layout: %v", err)
+		}
+		out = append(out, name+": "+sql)
+	}
+	return out
+}
+
+func TestMigrateOldLayouts(t *testing.T) {
+	for _, old := range oldLayouts {
+		t.Run(old.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if _, err := db.Exec(old.create); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(old.insert); err != nil {
+				t.Fatal(err)
+			}
+			if err := Migrate(db); err != nil {
+				t.Fatalf("Migrate: %v", err)
+			}
+			if got := users(t, db); !reflect.DeepEqual(got, old.want) {
+				t.Fatalf("users after migrating:\n got %v\nwant %v", got, old.want)
+			}
+			version, err := Version(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := migrations[len(migrations)-1].version; version != want {
+				t.Fatalf("version %d after migrating, want %d", version, want)
+			}
+		})
+	}
+}
+
+func TestMigrateTwice(t *testing.T) {
+	for _, old := range oldLayouts {
+		t.Run(old.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if _, err := db.Exec(old.create); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(old.insert); err != nil {
+				t.Fatal(err)
+			}
+			if err := Migrate(db); err != nil {
+				t.Fatalf("first Migrate: %v", err)
+			}
+			tables, rows := layout(t, db), users(t, db)
+			var applied int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&applied); err != nil {
+				t.Fatal(err)
+			}
+			if err := Migrate(db); err != nil {
+				t.Fatalf("second Migrate: %v", err)
+			}
+			if got := layout(t, db); !reflect.DeepEqual(got, tables) {
+				t.Fatalf("second Migrate changed the layout:\n got %v\nwant %v", got, tables)
+			}
+			if got := users(t, db); !reflect.DeepEqual(got, rows) {
+				t.Fatalf("second Migrate changed users:\n got %v\nwant %v", got, rows)
+			}
+			var again int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&again); err != nil {
+				t.Fatal(err)
+			}
+			if again != applied {
+				t.Fatalf("second Migrate recorded %d more migrations", again-applied)
+			}
+		})
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db := openTestDB(t)
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if got := users(t, db); len(got) != 0 {
+		t.Fatalf("new database has %d users", len(got))
+	}
+}
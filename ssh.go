@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"chatserver/auth"
+)
+
+// sshTerminal is a caller's end of an SSH session channel. The client
+// puts its own terminal in raw mode, so the server does all the echo and
+// line endings have to be written out in full.
+type sshTerminal struct {
+	ssh.Channel
+	keyReader
+	conn *ssh.ServerConn
+
+	mu       sync.Mutex
+	width    int
+	height   int
+	termType string
+}
+
+func newSSHTerminal(conn *ssh.ServerConn, ch ssh.Channel) *sshTerminal {
+	t := &sshTerminal{Channel: ch, conn: conn}
+	t.reader = bufio.NewReader(ch)
+	return t
+}
+
+// Write sends b with every bare LF turned into CR LF.
+func (t *sshTerminal) Write(b []byte) (int, error) {
+	out := make([]byte, 0, len(b)+8)
+	for i, ch := range b {
+		if ch == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, ch)
+	}
+	err := timedWrite(func() error {
+		_, err := t.Channel.Write(out)
+		return err
+	}, t.Close)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetEcho does nothing: an SSH client with a pty never echoes locally.
+func (t *sshTerminal) SetEcho(serverEchoes bool) {}
+
+// Size returns the window size from the client's pty request, or zeros
+// if it didn't ask for one.
+func (t *sshTerminal) Size() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.width, t.height
+}
+
+// Dumb reports whether the caller's terminal can't handle ANSI escapes.
+func (t *sshTerminal) Dumb() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return dumbTerminal(t.termType)
+}
+
+func (t *sshTerminal) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *sshTerminal) Secure() bool {
+	return true
+}
+
+func (t *sshTerminal) Kind() string {
+	return "ssh"
+}
+
+// Close hangs up the whole SSH connection, not just the channel.
+func (t *sshTerminal) Close() error {
+	t.Channel.Close()
+	return t.conn.Close()
+}
+
+// handleRequests answers the requests on a session channel, recording the
+// pty and window size. shell gets true once the client asks for a shell,
+// or false if the channel closes before it does.
+func (t *sshTerminal) handleRequests(requests <-chan *ssh.Request, shell chan<- bool) {
+	started := false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			var pty struct {
+				Term          string
+				Columns, Rows uint32
+				Width, Height uint32
+				Modes         string
+			}
+			if ssh.Unmarshal(req.Payload, &pty) == nil {
+				t.mu.Lock()
+				t.termType = strings.ToUpper(pty.Term)
+				t.width, t.height = int(pty.Columns), int(pty.Rows)
+				t.mu.Unlock()
+				ok = true
+			}
+		case "window-change":
+			var size struct {
+				Columns, Rows uint32
+				Width, Height uint32
+			}
+			if ssh.Unmarshal(req.Payload, &size) == nil {
+				t.mu.Lock()
+				t.width, t.height = int(size.Columns), int(size.Rows)
+				t.mu.Unlock()
+				ok = true
+			}
+		case "shell":
+			ok = !started
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if req.Type == "shell" && ok {
+			started = true
+			shell <- true
+		}
+	}
+	if !started {
+		shell <- false
+	}
+}
+
+// loadHostKey reads the SSH host key from path, creating a new ed25519
+// key there the first time the server starts.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "varidial host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		logger.Info("generated SSH host key", "path", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// sshConfig builds the server side of the handshake. The SSH user name is
+// a user number or handle; passwords go through the same check as the
+// telnet login, and accounts with registered keys may use those instead.
+func sshConfig(hostKey ssh.Signer, db *sql.DB) *ssh.ServerConfig {
+	// The account number travels in the permissions of whichever method
+	// succeeded, since the library may ask about several keys and
+	// passwords before one of them works.
+	accepted := func(number int) *ssh.Permissions {
+		return &ssh.Permissions{Extensions: map[string]string{"number": strconv.Itoa(number)}}
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			ip := hostOf(meta.RemoteAddr())
+			if addressLocked(db, ip) {
+				return nil, fmt.Errorf("address %s is locked out", ip)
+			}
+			number, _, err := findAccount(meta.User(), db)
+			if err == nil && accountLocked(db, number) {
+				logger.Info("refused locked-out account", "ip", ip, "number", number, "via", "ssh")
+				return nil, fmt.Errorf("account %d is locked out", number)
+			}
+			if err != nil {
+				auth.CheckPassword(auth.DummyHash, string(password))
+			}
+			if err != nil || login(number, string(password), db) == nil {
+				time.Sleep(failedLogin(db, number, ip, "ssh"))
+				return nil, fmt.Errorf("login failed for %s", meta.User())
+			}
+			return accepted(number), nil
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			number, _, err := findAccount(meta.User(), db)
+			if err != nil {
+				return nil, fmt.Errorf("no account %s", meta.User())
+			}
+			registered, err := hasSSHKey(number, key, db)
+			if err != nil {
+				logger.Error("checking SSH keys", "err", err)
+			}
+			if !registered {
+				return nil, fmt.Errorf("key not registered for %s", meta.User())
+			}
+			return accepted(number), nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	return cfg
+}
+
+// hasSSHKey reports whether key is registered to account number.
+func hasSSHKey(number int, key ssh.PublicKey, db *sql.DB) (bool, error) {
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM ssh_keys WHERE number = ? AND key = ?`, number, authorized).Scan(&count)
+	return count > 0, err
+}
+
+// serveSSH accepts SSH connections on ln until it is closed.
+func serveSSH(ln net.Listener, cfg *ssh.ServerConfig, db *sql.DB) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Error("accepting SSH connection", "err", err)
+			return
+		}
+		go handleSSH(conn, cfg, db)
+	}
+}
+
+func handleSSH(nc net.Conn, cfg *ssh.ServerConfig, db *sql.DB) {
+	defer trackCall(nc)()
+	host := hostOf(nc.RemoteAddr())
+	ban, err := addressBan(db, host)
+	if err != nil {
+		logger.Error("checking bans", "ip", host, "err", err)
+	}
+	if ban != nil {
+		logger.Info("refused banned address", "ip", host)
+		// there is no way to show a message before the handshake
+		nc.Close()
+		return
+	}
+	// passwords are limited per connection like at the telnet prompt;
+	// the library's own MaxAuthTries also counts every key a client
+	// offers, so it can't be used for this
+	tries := 0
+	connCfg := *cfg
+	connCfg.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		tries++
+		perms, err := cfg.PasswordCallback(meta, password)
+		if err != nil && tries >= conf.LoginTries {
+			nc.Close()
+		}
+		return perms, err
+	}
+	nc.SetDeadline(time.Now().Add(time.Minute))
+	conn, chans, reqs, err := ssh.NewServerConn(nc, &connCfg)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(reqs)
+
+	number, _ := strconv.Atoi(conn.Permissions.Extensions["number"])
+	user, _, err := loadAccount(number, db)
+	if err != nil {
+		logger.Error("loading account", "ip", host, "number", number, "err", err)
+		conn.Close()
+		return
+	}
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			break
+		}
+		t := newSSHTerminal(conn, ch)
+		shell := make(chan bool, 1)
+		go t.handleRequests(requests, shell)
+		if !<-shell {
+			ch.Close()
+			continue
+		}
+		// one chat session per connection
+		go func() {
+			for extra := range chans {
+				extra.Reject(ssh.Prohibited, "already in a session")
+			}
+		}()
+		enterChat(t, user, db)
+		return
+	}
+	conn.Close()
+}
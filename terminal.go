@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/PatrickRudolph/telnet"
+)
+
+// Terminal is the caller's end of a telnet connection: a single buffered
+// reader for everything they type, plus what option negotiation has told
+// us about their screen.
+type Terminal struct {
+	*telnet.Connection
+	keyReader
+	secure bool
+
+	mu       sync.Mutex
+	width    int
+	height   int
+	termType string
+}
+
+func newTerminal(c net.Conn) *Terminal {
+	_, secure := c.(*tls.Conn)
+	t := &Terminal{secure: secure}
+	t.Connection = telnet.NewConnection(c, []telnet.Option{
+		func(*telnet.Connection) telnet.Negotiator { return &echoHandler{} },
+		func(*telnet.Connection) telnet.Negotiator { return &sgaHandler{} },
+		func(*telnet.Connection) telnet.Negotiator { return &nawsHandler{t: t} },
+		func(*telnet.Connection) telnet.Negotiator { return &ttypeHandler{t: t} },
+	})
+	t.reader = bufio.NewReader(t.Connection)
+	return t
+}
+
+// Write sends b as NVT text: IAC bytes are doubled, a bare LF becomes
+// CR LF and a bare CR becomes CR NUL.
+func (t *Terminal) Write(b []byte) (int, error) {
+	out := make([]byte, 0, len(b)+8)
+	for i, ch := range b {
+		switch {
+		case ch == telnet.IAC:
+			out = append(out, telnet.IAC, telnet.IAC)
+		case ch == '\n' && (i == 0 || b[i-1] != '\r'):
+			out = append(out, '\r', '\n')
+		case ch == '\r' && (i+1 == len(b) || b[i+1] != '\n'):
+			out = append(out, '\r', 0)
+		default:
+			out = append(out, ch)
+		}
+	}
+	err := timedWrite(func() error {
+		_, err := t.RawWrite(out)
+		return err
+	}, t.Close)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetEcho asks the client to stop (serverEchoes true) or resume echoing
+// what the caller types. Terminal itself never echoes, so turning it on
+// hides input such as passwords; a Session's line editor does its own
+// echo once the caller is logged in.
+func (t *Terminal) SetEcho(serverEchoes bool) {
+	if serverEchoes {
+		t.RawWrite([]byte{telnet.IAC, telnet.WILL, telnet.TeloptECHO})
+	} else {
+		t.RawWrite([]byte{telnet.IAC, telnet.WONT, telnet.TeloptECHO})
+	}
+}
+
+// Secure reports whether the caller came in on the TLS listener.
+func (t *Terminal) Secure() bool {
+	return t.secure
+}
+
+func (t *Terminal) Kind() string {
+	if t.secure {
+		return "tls"
+	}
+	return "telnet"
+}
+
+// Size returns the window size reported through NAWS, or zeros if the
+// client never sent one.
+func (t *Terminal) Size() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.width, t.height
+}
+
+// Type returns the terminal type reported through TTYPE, upper-cased, or
+// "" if the client never sent one.
+func (t *Terminal) Type() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.termType
+}
+
+// Dumb reports whether the caller's terminal can't handle ANSI escapes.
+func (t *Terminal) Dumb() bool {
+	return dumbTerminal(t.Type())
+}
+
+// echoHandler answers the client's side of ECHO negotiation so the
+// library doesn't refuse it on our behalf. Echo is switched with SetEcho.
+type echoHandler struct{}
+
+func (e *echoHandler) OptionCode() byte              { return telnet.TeloptECHO }
+func (e *echoHandler) Offer(c *telnet.Connection)    {}
+func (e *echoHandler) HandleDo(c *telnet.Connection) {}
+func (e *echoHandler) HandleWill(c *telnet.Connection) {
+	// We never want the client to echo our output back to us.
+	c.RawWrite([]byte{telnet.IAC, telnet.DONT, telnet.TeloptECHO})
+}
+func (e *echoHandler) HandleSB(c *telnet.Connection, body []byte) {}
+
+// sgaHandler offers SUPPRESS-GO-AHEAD, which clients expect alongside
+// server-side echo.
+type sgaHandler struct{}
+
+func (e *sgaHandler) OptionCode() byte { return telnet.TeloptSGA }
+func (e *sgaHandler) Offer(c *telnet.Connection) {
+	c.RawWrite([]byte{telnet.IAC, telnet.WILL, telnet.TeloptSGA})
+}
+func (e *sgaHandler) HandleDo(c *telnet.Connection)              {}
+func (e *sgaHandler) HandleWill(c *telnet.Connection)            {}
+func (e *sgaHandler) HandleSB(c *telnet.Connection, body []byte) {}
+
+// nawsHandler records the window size the client reports (RFC 1073).
+type nawsHandler struct {
+	t *Terminal
+}
+
+func (n *nawsHandler) OptionCode() byte { return telnet.TeloptNAWS }
+func (n *nawsHandler) Offer(c *telnet.Connection) {
+	c.RawWrite([]byte{telnet.IAC, telnet.DO, telnet.TeloptNAWS})
+}
+func (n *nawsHandler) HandleDo(c *telnet.Connection) {
+	c.RawWrite([]byte{telnet.IAC, telnet.WONT, telnet.TeloptNAWS})
+}
+func (n *nawsHandler) HandleWill(c *telnet.Connection) {}
+func (n *nawsHandler) HandleSB(c *telnet.Connection, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	n.t.mu.Lock()
+	defer n.t.mu.Unlock()
+	n.t.width = int(binary.BigEndian.Uint16(body[0:2]))
+	n.t.height = int(binary.BigEndian.Uint16(body[2:4]))
+}
+
+// ttypeHandler asks for and records the client's terminal type (RFC 1091).
+type ttypeHandler struct {
+	t *Terminal
+}
+
+func (h *ttypeHandler) OptionCode() byte { return telnet.TeloptTTYPE }
+func (h *ttypeHandler) Offer(c *telnet.Connection) {
+	c.RawWrite([]byte{telnet.IAC, telnet.DO, telnet.TeloptTTYPE})
+}
+func (h *ttypeHandler) HandleDo(c *telnet.Connection) {
+	c.RawWrite([]byte{telnet.IAC, telnet.WONT, telnet.TeloptTTYPE})
+}
+func (h *ttypeHandler) HandleWill(c *telnet.Connection) {
+	c.RawWrite([]byte{telnet.IAC, telnet.SB, telnet.TeloptTTYPE, telnet.TelQualSEND, telnet.IAC, telnet.SE})
+}
+func (h *ttypeHandler) HandleSB(c *telnet.Connection, body []byte) {
+	if len(body) < 2 || body[0] != telnet.TelQualIS {
+		return
+	}
+	h.t.mu.Lock()
+	defer h.t.mu.Unlock()
+	h.t.termType = strings.ToUpper(string(body[1:]))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/PatrickRudolph/telnet"
+)
+
+func TestReadKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "abc", "abc"},
+		{"CR LF", "a\r\nb", "a\rb"},
+		{"CR NUL", "a\r\x00b", "a\rb"},
+		{"lone CR", "a\rb", "a\rb"},
+		{"lone LF", "a\nb", "a\rb"},
+		{"CR at the end", "a\r", "a\r"},
+		{"two Enters", "\r\n\r\n", "\r\r"},
+		{"CR CR", "\r\r", "\r\r"},
+		{"LF CR", "\n\r", "\r\r"},
+		{"stray NULs", "\x00a\x00b", "ab"},
+		{"other control keys", "\x1b[A\b\x7f", "\x1b[A\b\x7f"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := keyReader{reader: bufio.NewReader(strings.NewReader(tt.input))}
+			var got []byte
+			for {
+				ch, err := k.ReadKey()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, ch)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("keys %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "hello", "hello"},
+		{"CR LF kept", "a\r\nb", "a\r\nb"},
+		{"bare LF", "a\nb", "a\r\nb"},
+		{"LF first", "\na", "\r\na"},
+		{"bare CR", "a\rb", "a\r\x00b"},
+		{"CR last", "a\r", "a\r\x00"},
+		{"IAC doubled", "a\xffb", "a\xff\xffb"},
+		{"everything", "\xff\n\r\r\n", "\xff\xff\r\n\r\x00\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			term := &Terminal{Connection: &telnet.Connection{Conn: server}}
+			got := make(chan string, 1)
+			go func() {
+				b, _ := io.ReadAll(client)
+				got <- string(b)
+			}()
+			n, err := term.Write([]byte(tt.input))
+			if err != nil || n != len(tt.input) {
+				t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(tt.input))
+			}
+			server.Close()
+			if out := <-got; out != tt.want {
+				t.Fatalf("wrote %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"bufio"
 	"database/sql"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"chatserver/auth"
+	"chatserver/config"
+	"chatserver/schema"
 )
 
 type User struct {
@@ -22,6 +27,14 @@ type User struct {
 }
 
 func main() {
+	configFile := flag.String("config", "varidial.conf", "path to the server configuration file")
+	flag.Parse()
+	conf, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return
+	}
+
 	var user User
 
 	reader := bufio.NewReader(os.Stdin)
@@ -56,7 +69,11 @@ func main() {
 		fmt.Println("Error: password must be 8 characters and less than 13")
 		return
 	}
-	user.Password = password
+	user.Password, err = auth.HashPassword(password)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		return
+	}
 
 	fmt.Print("Enter level (0 to 4): ")
 	levelStr, _ := reader.ReadString('\n')
@@ -67,17 +84,18 @@ func main() {
 		return
 	}
 	user.Level = level
+	user.Channel = 1
 
-	fmt.Println("User struct initialized:", user)
+	fmt.Printf("User struct initialized: %s #%03d level %d\n", user.Username, user.Number, user.Level)
 
-	db, err := sql.Open("sqlite3", "./users.db")
+	db, err := sql.Open("sqlite3", conf.Database)
 	if err != nil {
 		fmt.Println("Error opening database:", err)
 		return
 	}
 	defer db.Close()
 
-	err = initializeDB(db)
+	err = schema.Migrate(db)
 	if err != nil {
 		fmt.Println("Error initializing database:", err)
 		return
@@ -92,7 +110,7 @@ func main() {
 }
 
 func saveUser(db *sql.DB, user User) error {
-	query := `INSERT INTO users (username, number, password, level, channel) VALUES (?, ?, ?, ?, ?)`
+	query := `INSERT INTO users (active, username, number, password, level, channel) VALUES (1, ?, ?, ?, ?, ?)`
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return err
@@ -104,21 +122,3 @@ func saveUser(db *sql.DB, user User) error {
 	}
 	return nil
 }
-
-func initializeDB(db *sql.DB) error {
-	query := `
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username VARCHAR(14) NOT NULL,
-			number INTEGER NOT NULL,
-			password VARCHAR(13) NOT NULL,
-			level INTEGER NOT NULL,
-			channel INTEGER NOT NULL
-			);
-			`
-	_, err := db.Exec(query)
-	if err != nil {
-		return err
-	}
-	return nil
-}
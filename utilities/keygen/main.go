@@ -4,9 +4,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"flag"
 	"fmt"
 	"io"
 	"strings"
+
+	"chatserver/config"
 )
 
 /*
@@ -14,12 +17,10 @@ This code demonstrates how to use the `generateKey` and `readKey` functions to e
 The `generateKey` function takes a username, date format, and number as input and returns an encrypted ciphertext.
 The `readKey` function takes the ciphertext as input, decrypts it, and returns the original username,
 date format, and number values.
+Both use the AES key from the `key` setting in varidial.conf.
 */
 
-func generateKey(username string, dateFormat string, number int) ([]byte, error) {
-	// AES key (must be 32 bytes)
-	key := []byte("your_secret_key_must_be_32_bytes")
-
+func generateKey(key []byte, username string, dateFormat string, number int) ([]byte, error) {
 	// Format the plaintext string
 	plaintext := []byte(fmt.Sprintf("%s###%s###%03d", username, dateFormat, number))
 
@@ -45,10 +46,7 @@ func generateKey(username string, dateFormat string, number int) ([]byte, error)
 	return ciphertext, nil
 }
 
-func readKey(ciphertext []byte) (username string, dateFormat string, number int, err error) {
-	// AES key (must be 32 bytes)
-	key := []byte("your_secret_key_must_be_32_bytes")
-
+func readKey(key []byte, ciphertext []byte) (username string, dateFormat string, number int, err error) {
 	// Generate a new cipher block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -75,12 +73,21 @@ func readKey(ciphertext []byte) (username string, dateFormat string, number int,
 }
 
 func main() {
-	ciphertext, err := generateKey("your_username", "020923", 123)
+	configFile := flag.String("config", "varidial.conf", "path to the server configuration file")
+	flag.Parse()
+	conf, err := config.Load(*configFile)
+	if err != nil {
+		panic(err)
+	}
+	// AES key (must be 16, 24 or 32 bytes)
+	key := []byte(conf.Key)
+
+	ciphertext, err := generateKey(key, "your_username", "020923", 123)
 	if err != nil {
 		panic(err)
 	}
 
-	username, dateFormat, number, err := readKey(ciphertext)
+	username, dateFormat, number, err := readKey(key, ciphertext)
 	if err != nil {
 		panic(err)
 	}
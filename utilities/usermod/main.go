@@ -2,33 +2,31 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-)
+	"golang.org/x/crypto/ssh"
 
-func createTable(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			active INT NOT NULL,
-			username TEXT NOT NULL,
-			number INT NOT NULL,
-			password TEXT NOT NULL,
-			level INT NOT NULL
-		)
-	`)
-	return err
-}
+	"chatserver/auth"
+	"chatserver/config"
+	"chatserver/schema"
+)
 
 func addUser(db *sql.DB, active int, username string, number int, password string, level int) (int64, error) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
 	res, err := db.Exec(`
-		INSERT INTO users (active, username, number, password, level)
-		VALUES (?, ?, ?, ?, ?)
-	`, active, username, number, password, level)
+		INSERT INTO users (active, username, number, password, level, channel)
+		VALUES (?, ?, ?, ?, ?, 1)
+	`, active, username, number, hash, level)
 	if err != nil {
 		return 0, err
 	}
@@ -39,30 +37,33 @@ func addUser(db *sql.DB, active int, username string, number int, password strin
 	return lastID, nil
 }
 
-func getUser(db *sql.DB, id int) (int, int, string, int, string, int, error) {
+func getUser(db *sql.DB, id int) (int, int, string, int, int, error) {
 	var active int
 	var username string
 	var number int
-	var password string
 	var level int
 	row := db.QueryRow(`
-		SELECT active, username, number, password, level
+		SELECT active, username, number, level
 		FROM users
 		WHERE id = ?
 	`, id)
-	err := row.Scan(&active, &username, &number, &password, &level)
+	err := row.Scan(&active, &username, &number, &level)
 	if err != nil {
-		return 0, 0, "", 0, "", 0, err
+		return 0, 0, "", 0, 0, err
 	}
-	return id, active, username, number, password, level, nil
+	return id, active, username, number, level, nil
 }
 
 func updateUser(db *sql.DB, id int, active int, password string) (int64, error) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
 	res, err := db.Exec(`
 		UPDATE users
 		SET active = ?, password = ?
 		WHERE id = ?
-	`, active, password, id)
+	`, active, hash, id)
 	if err != nil {
 		return 0, err
 	}
@@ -90,7 +91,7 @@ func deleteUser(db *sql.DB, id int) (int64, error) {
 
 func listUsers(db *sql.DB) error {
 	rows, err := db.Query(`
-		SELECT id, active, username, number, password, level
+		SELECT id, active, username, number, level
 		FROM users
 	`)
 	if err != nil {
@@ -102,25 +103,331 @@ func listUsers(db *sql.DB) error {
 		var active int
 		var username string
 		var number int
-		var password string
 		var level int
-		if err := rows.Scan(&id, &active, &username, &number, &password, &level); err != nil {
+		if err := rows.Scan(&id, &active, &username, &number, &level); err != nil {
 			return err
 		}
-		fmt.Printf("id: %d, active: %d, username: %s, number: %d, password: %s, level: %d\n", id, active, username, number, password, level)
+		fmt.Printf("id: %d, active: %d, username: %s, number: %d, level: %d\n", id, active, username, number, level)
 	}
 	return rows.Err()
 }
 
+func listApplications(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT id, username, ip, created
+		FROM applications
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+	type application struct {
+		id       int
+		username string
+		ip       string
+		created  int64
+	}
+	var apps []application
+	for rows.Next() {
+		var app application
+		if err := rows.Scan(&app.id, &app.username, &app.ip, &app.created); err != nil {
+			rows.Close()
+			return err
+		}
+		apps = append(apps, app)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, app := range apps {
+		fmt.Printf("id: %d, username: %s, applied: %s from %s\n", app.id, app.username, time.Unix(app.created, 0).Format("2006-01-02 15:04"), app.ip)
+		answers, err := db.Query(`
+			SELECT question, answer
+			FROM application_answers
+			WHERE application_id = ?
+			ORDER BY rowid
+		`, app.id)
+		if err != nil {
+			return err
+		}
+		for answers.Next() {
+			var question, answer string
+			if err := answers.Scan(&question, &answer); err != nil {
+				answers.Close()
+				return err
+			}
+			fmt.Printf("    %s %s\n", question, answer)
+		}
+		answers.Close()
+		if err := answers.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func approveApplication(db *sql.DB, id int, number int, level int) (int64, error) {
+	// everything happens in one transaction, so an approval that fails
+	// part way leaves neither a new account nor a lost application
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var username, password string
+	err = tx.QueryRow(`
+		SELECT username, password
+		FROM applications
+		WHERE id = ?
+	`, id).Scan(&username, &password)
+	if err != nil {
+		return 0, err
+	}
+	var taken int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM users WHERE number = ?`, number).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken > 0 {
+		return 0, fmt.Errorf("user number %d is already assigned", number)
+	}
+	err = tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ? COLLATE NOCASE`, username).Scan(&taken)
+	if err != nil {
+		return 0, err
+	}
+	if taken > 0 {
+		return 0, fmt.Errorf("handle %s already belongs to an account", username)
+	}
+	res, err := tx.Exec(`
+		INSERT INTO users (active, username, number, password, level, channel)
+		VALUES (1, ?, ?, ?, ?, 1)
+	`, username, number, password, level)
+	if err != nil {
+		return 0, err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := removeApplication(tx, id); err != nil {
+		return 0, err
+	}
+	return lastID, tx.Commit()
+}
+
+func deleteApplication(db *sql.DB, id int) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	n, err := removeApplication(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// removeApplication deletes application id and its answers within tx.
+func removeApplication(tx *sql.Tx, id int) (int64, error) {
+	_, err := tx.Exec(`
+		DELETE FROM application_answers
+		WHERE application_id = ?
+	`, id)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+		DELETE FROM applications
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func listRequests(db *sql.DB, all bool) error {
+	query := `
+		SELECT id, email, ip, note, status, created
+		FROM account_requests
+		WHERE status = 'pending'
+		ORDER BY id
+	`
+	if all {
+		query = `
+			SELECT id, email, ip, note, status, created
+			FROM account_requests
+			ORDER BY id
+		`
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var email, ip, note, status string
+		var created int64
+		if err := rows.Scan(&id, &email, &ip, &note, &status, &created); err != nil {
+			return err
+		}
+		fmt.Printf("id: %d, email: %s, ip: %s, status: %s, requested: %s, note: %s\n", id, email, ip, status, time.Unix(created, 0).Format("2006-01-02 15:04"), note)
+	}
+	return rows.Err()
+}
+
+func setRequestStatus(db *sql.DB, id int, status string) (int64, error) {
+	res, err := db.Exec(`
+		UPDATE account_requests
+		SET status = ?
+		WHERE id = ? AND status = 'pending'
+	`, status, id)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func listBans(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT id, number, ip, reason, banned_by, expires
+		FROM bans
+		WHERE expires > ?
+		ORDER BY id
+	`, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var number sql.NullInt64
+		var ip sql.NullString
+		var reason, bannedBy string
+		var expires int64
+		if err := rows.Scan(&id, &number, &ip, &reason, &bannedBy, &expires); err != nil {
+			return err
+		}
+		target := ip.String
+		if number.Valid {
+			target = fmt.Sprintf("#%03d", number.Int64)
+		}
+		fmt.Printf("id: %d, banned: %s, by: %s, until: %s, reason: %s\n", id, target, bannedBy, time.Unix(expires, 0).Format("2006-01-02 15:04"), reason)
+	}
+	return rows.Err()
+}
+
+// addBan bans a user number, or an IP address if target isn't a number.
+func addBan(db *sql.DB, target string, hours int, reason string) (int64, error) {
+	now := time.Now()
+	expires := now.Add(time.Duration(hours) * time.Hour).Unix()
+	var res sql.Result
+	var err error
+	if number, convErr := strconv.Atoi(target); convErr == nil {
+		res, err = db.Exec(`
+			INSERT INTO bans (number, reason, banned_by, created, expires)
+			VALUES (?, ?, 'usermod', ?, ?)
+		`, number, reason, now.Unix(), expires)
+	} else {
+		res, err = db.Exec(`
+			INSERT INTO bans (ip, reason, banned_by, created, expires)
+			VALUES (?, ?, 'usermod', ?, ?)
+		`, target, reason, now.Unix(), expires)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func liftBan(db *sql.DB, id int) (int64, error) {
+	res, err := db.Exec(`
+		UPDATE bans
+		SET expires = ?
+		WHERE id = ? AND expires > ?
+	`, time.Now().Unix(), id, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func listKeys(db *sql.DB, number int) error {
+	rows, err := db.Query(`
+		SELECT id, key, comment, added
+		FROM ssh_keys
+		WHERE number = ?
+		ORDER BY id
+	`, number)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var key, comment string
+		var added int64
+		if err := rows.Scan(&id, &key, &comment, &added); err != nil {
+			return err
+		}
+		fields := strings.Fields(key)
+		fmt.Printf("id: %d, type: %s, comment: %s, added: %s\n", id, fields[0], comment, time.Unix(added, 0).Format("2006-01-02 15:04"))
+	}
+	return rows.Err()
+}
+
+// addKey registers an SSH public key, given as an authorized_keys line,
+// for user number.
+func addKey(db *sql.DB, number int, line string) (int64, error) {
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(`
+		INSERT INTO ssh_keys (number, key, comment, added)
+		VALUES (?, ?, ?, ?)
+	`, number, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), comment, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func deleteKey(db *sql.DB, id int) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM ssh_keys
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func showHelp() {
-	fmt.Println("Usage: go run main.go <command> <arguments>")
+	fmt.Println("Usage: go run main.go [-config varidial.conf] <command> <arguments>")
 	fmt.Println("\nCommands:")
-	fmt.Println("  create\t\tCreate the users table")
+	fmt.Println("  create\t\tCreate or upgrade the database tables")
 	fmt.Println("  add\t\t\tAdd a new user to the users table")
 	fmt.Println("  get\t\t\tGet a user from the users table")
 	fmt.Println("  update\t\tUpdate a user in the users table")
 	fmt.Println("  delete\t\tDelete a user from the users table")
 	fmt.Println("  list\t\tList all users in the users table")
+	fmt.Println("  apps\t\tList pending new-user applications")
+	fmt.Println("  approve\t\tApprove an application into a numbered account")
+	fmt.Println("  reject\t\tReject and remove an application")
+	fmt.Println("  requests\t\tList pending /r account requests")
+	fmt.Println("  grant\t\t\tMark an account request as approved")
+	fmt.Println("  deny\t\t\tMark an account request as rejected")
+	fmt.Println("  bans\t\t\tList active bans")
+	fmt.Println("  ban\t\t\tBan a user number or IP address")
+	fmt.Println("  unban\t\tLift a ban")
+	fmt.Println("  keys\t\t\tList the SSH keys registered to a user")
+	fmt.Println("  addkey\t\tRegister an SSH public key for a user")
+	fmt.Println("  delkey\t\tRemove a registered SSH key")
 	fmt.Println("  help\t\tShow this help message")
 	fmt.Println("\nArguments:")
 	fmt.Println("  <command> create\t\tNo arguments needed")
@@ -129,25 +436,51 @@ func showHelp() {
 	fmt.Println("  <command> update\t\tID of the user to update, active (1/0), password")
 	fmt.Println("  <command> delete\t\tID of the user to delete")
 	fmt.Println("  <command> list\t\tNo arguments needed")
+	fmt.Println("  <command> apps\t\tNo arguments needed")
+	fmt.Println("  <command> approve\t\tID of the application, user number, level")
+	fmt.Println("  <command> reject\t\tID of the application")
+	fmt.Println("  <command> requests\t\tOptional \"all\" to include handled requests")
+	fmt.Println("  <command> grant\t\tID of the account request")
+	fmt.Println("  <command> deny\t\tID of the account request")
+	fmt.Println("  <command> bans\t\tNo arguments needed")
+	fmt.Println("  <command> ban\t\tUser number or IP address, hours, reason")
+	fmt.Println("  <command> unban\t\tID of the ban")
+	fmt.Println("  <command> keys\t\tUser number")
+	fmt.Println("  <command> addkey\t\tUser number, public key as in authorized_keys")
+	fmt.Println("  <command> delkey\t\tID of the key")
 	fmt.Println("  <command> help\t\tNo arguments needed")
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	configFile := flag.String("config", "varidial.conf", "path to the server configuration file")
+	flag.Parse()
+	// args is os.Args without the flags, so the command is still args[1]
+	args := append([]string{os.Args[0]}, flag.Args()...)
+	if len(args) < 2 {
 		log.Fatalf("Expected at least one command-line argument")
 	}
-	fmt.Println("Command: ", os.Args[1])
-	db, err := sql.Open("sqlite3", "./users.db")
+	fmt.Println("Command: ", args[1])
+	conf, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	db, err := sql.Open("sqlite3", conf.Database)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer db.Close()
 
-	err = createTable(db)
+	err = schema.Migrate(db)
 	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+		log.Fatalf("Error migrating database: %v", err)
 	}
-	switch os.Args[1] {
+	switch args[1] {
+	case "create":
+		version, err := schema.Version(db)
+		if err != nil {
+			log.Fatalf("Error reading schema version: %v", err)
+		}
+		fmt.Println("Database is at schema version", version)
 	case "list":
 		err := listUsers(db)
 		if err != nil {
@@ -157,25 +490,25 @@ func main() {
 		showHelp()
 	case "add":
 		fmt.Println("Adding user...")
-		if len(os.Args) < 5 {
+		if len(args) < 5 {
 			log.Fatalf("Expected 5 arguments for creating user")
 		}
-		active, _ := strconv.Atoi(os.Args[2])
-		username := os.Args[3]
-		number, _ := strconv.Atoi(os.Args[4])
-		password := os.Args[5]
-		level, _ := strconv.Atoi(os.Args[6])
+		active, _ := strconv.Atoi(args[2])
+		username := args[3]
+		number, _ := strconv.Atoi(args[4])
+		password := args[5]
+		level, _ := strconv.Atoi(args[6])
 		lastID, err := addUser(db, active, username, number, password, level)
 		if err != nil {
 			log.Fatalf("Error adding user: %v", err)
 		}
 		fmt.Println("User added with ID:", lastID)
 	case "read":
-		if len(os.Args) < 3 {
+		if len(args) < 3 {
 			log.Fatalf("Expected 2 arguments for reading user")
 		}
-		id, _ := strconv.Atoi(os.Args[2])
-		_, active, username, number, password, level, err := getUser(db, id)
+		id, _ := strconv.Atoi(args[2])
+		_, active, username, number, level, err := getUser(db, id)
 		if err != nil {
 			log.Fatalf("Error getting user: %v", err)
 		}
@@ -184,30 +517,136 @@ func main() {
 		fmt.Println("Active:", active)
 		fmt.Println("Username:", username)
 		fmt.Println("Number:", number)
-		fmt.Println("Password:", password)
 		fmt.Println("Level:", level)
 	case "update":
-		if len(os.Args) < 5 {
+		if len(args) < 5 {
 			log.Fatalf("Expected 4 arguments for updating user")
 		}
-		id, _ := strconv.Atoi(os.Args[2])
-		active, _ := strconv.Atoi(os.Args[3])
-		password := os.Args[4]
+		id, _ := strconv.Atoi(args[2])
+		active, _ := strconv.Atoi(args[3])
+		password := args[4]
 		affect, err := updateUser(db, id, active, password)
 		if err != nil {
 			log.Fatalf("Error updating user: %v", err)
 		}
 		fmt.Println("Number of rows affected:", affect)
 	case "delete":
-		if len(os.Args) < 3 {
+		if len(args) < 3 {
 			log.Fatalf("Expected 2 arguments for deleting user")
 		}
-		id, _ := strconv.Atoi(os.Args[2])
+		id, _ := strconv.Atoi(args[2])
 		affect, err := deleteUser(db, id)
 		if err != nil {
 			log.Fatalf("Error deleting user: %v", err)
 		}
 		fmt.Println("Number of rows affected:", affect)
+	case "apps":
+		err := listApplications(db)
+		if err != nil {
+			log.Fatalf("Error listing applications: %v", err)
+		}
+	case "approve":
+		if len(args) < 5 {
+			log.Fatalf("Expected 3 arguments for approving an application")
+		}
+		id, _ := strconv.Atoi(args[2])
+		number, _ := strconv.Atoi(args[3])
+		level, _ := strconv.Atoi(args[4])
+		lastID, err := approveApplication(db, id, number, level)
+		if err != nil {
+			log.Fatalf("Error approving application: %v", err)
+		}
+		fmt.Println("User added with ID:", lastID)
+	case "reject":
+		if len(args) < 3 {
+			log.Fatalf("Expected 2 arguments for rejecting an application")
+		}
+		id, _ := strconv.Atoi(args[2])
+		affect, err := deleteApplication(db, id)
+		if err != nil {
+			log.Fatalf("Error rejecting application: %v", err)
+		}
+		fmt.Println("Number of rows affected:", affect)
+	case "requests":
+		err := listRequests(db, len(args) > 2 && args[2] == "all")
+		if err != nil {
+			log.Fatalf("Error listing requests: %v", err)
+		}
+	case "grant", "deny":
+		if len(args) < 3 {
+			log.Fatalf("Expected 2 arguments for handling an account request")
+		}
+		id, _ := strconv.Atoi(args[2])
+		status := "approved"
+		if args[1] == "deny" {
+			status = "rejected"
+		}
+		affect, err := setRequestStatus(db, id, status)
+		if err != nil {
+			log.Fatalf("Error updating request: %v", err)
+		}
+		fmt.Println("Number of rows affected:", affect)
+	case "bans":
+		err := listBans(db)
+		if err != nil {
+			log.Fatalf("Error listing bans: %v", err)
+		}
+	case "ban":
+		if len(args) < 4 {
+			log.Fatalf("Expected at least 3 arguments for banning")
+		}
+		hours, err := strconv.Atoi(args[3])
+		if err != nil || hours <= 0 {
+			log.Fatalf("Invalid number of hours: %s", args[3])
+		}
+		reason := "no reason given"
+		if len(args) > 4 {
+			reason = strings.Join(args[4:], " ")
+		}
+		lastID, err := addBan(db, args[2], hours, reason)
+		if err != nil {
+			log.Fatalf("Error adding ban: %v", err)
+		}
+		fmt.Println("Ban added with ID:", lastID)
+	case "unban":
+		if len(args) < 3 {
+			log.Fatalf("Expected 2 arguments for lifting a ban")
+		}
+		id, _ := strconv.Atoi(args[2])
+		affect, err := liftBan(db, id)
+		if err != nil {
+			log.Fatalf("Error lifting ban: %v", err)
+		}
+		fmt.Println("Number of rows affected:", affect)
+	case "keys":
+		if len(args) < 3 {
+			log.Fatalf("Expected 2 arguments for listing keys")
+		}
+		number, _ := strconv.Atoi(args[2])
+		err := listKeys(db, number)
+		if err != nil {
+			log.Fatalf("Error listing keys: %v", err)
+		}
+	case "addkey":
+		if len(args) < 4 {
+			log.Fatalf("Expected at least 3 arguments for adding a key")
+		}
+		number, _ := strconv.Atoi(args[2])
+		lastID, err := addKey(db, number, strings.Join(args[3:], " "))
+		if err != nil {
+			log.Fatalf("Error adding key: %v", err)
+		}
+		fmt.Println("Key added with ID:", lastID)
+	case "delkey":
+		if len(args) < 3 {
+			log.Fatalf("Expected 2 arguments for removing a key")
+		}
+		id, _ := strconv.Atoi(args[2])
+		affect, err := deleteKey(db, id)
+		if err != nil {
+			log.Fatalf("Error removing key: %v", err)
+		}
+		fmt.Println("Number of rows affected:", affect)
 	default:
 		log.Fatalf("X:Unsupported command-line argument")
 		showHelp()
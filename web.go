@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+//go:embed web/index.html
+var webPage []byte
+
+// webTerminal is a caller using the terminal page in a browser. Binary
+// WebSocket frames carry what the caller types and what the server writes
+// back, exactly as telnet would; text frames carry control messages: the
+// page sends "size cols rows", and the server sends "echo on" or
+// "echo off" in place of telnet's ECHO negotiation.
+type webTerminal struct {
+	ws *websocket.Conn
+	keyReader
+	addr net.Addr
+
+	pending []byte // rest of the last binary frame not yet read
+
+	mu     sync.Mutex
+	width  int
+	height int
+}
+
+// frame is one WebSocket message and its payload type.
+type frame struct {
+	payloadType byte
+	data        []byte
+}
+
+var frameCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*frame)
+		f.payloadType = payloadType
+		f.data = data
+		return nil
+	},
+}
+
+func newWebTerminal(ws *websocket.Conn) *webTerminal {
+	t := &webTerminal{ws: ws}
+	t.reader = bufio.NewReader(t)
+	// ws.RemoteAddr is the page's origin, not the caller's address.
+	t.addr, _ = net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if t.addr == nil {
+		t.addr = ws.RemoteAddr()
+	}
+	if viaProxy(ws.Request()) {
+		if ip := forwardedFor(ws.Request()); ip != nil {
+			t.addr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return t
+}
+
+// viaProxy reports whether r came through conf.WebProxy. Only then are
+// its X-Forwarded headers believed; anyone else could make them up.
+func viaProxy(r *http.Request) bool {
+	if conf.WebProxy == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err == nil && net.ParseIP(host).Equal(net.ParseIP(conf.WebProxy))
+}
+
+// forwardedFor returns the caller's address as the proxy recorded it: the
+// last one in X-Forwarded-For, since anything before it came from the
+// caller and may be forged.
+func forwardedFor(r *http.Request) net.IP {
+	header := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	addrs := strings.Split(header, ",")
+	return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+}
+
+// Read returns typed bytes from binary frames, acting on any control
+// messages that arrive in between.
+func (t *webTerminal) Read(p []byte) (int, error) {
+	for len(t.pending) == 0 {
+		var f frame
+		if err := frameCodec.Receive(t.ws, &f); err != nil {
+			return 0, err
+		}
+		if f.payloadType == websocket.BinaryFrame {
+			t.pending = f.data
+		} else {
+			t.control(string(f.data))
+		}
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+func (t *webTerminal) control(message string) {
+	fields := strings.Fields(message)
+	if len(fields) == 3 && fields[0] == "size" {
+		width, err1 := strconv.Atoi(fields[1])
+		height, err2 := strconv.Atoi(fields[2])
+		if err1 == nil && err2 == nil {
+			t.mu.Lock()
+			t.width, t.height = width, height
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *webTerminal) Write(b []byte) (int, error) {
+	err := timedWrite(func() error {
+		return websocket.Message.Send(t.ws, b)
+	}, t.Close)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetEcho tells the page whether to stop echoing (serverEchoes true) and
+// send each key as it is typed, or go back to editing lines locally.
+func (t *webTerminal) SetEcho(serverEchoes bool) {
+	if serverEchoes {
+		websocket.Message.Send(t.ws, "echo on")
+	} else {
+		websocket.Message.Send(t.ws, "echo off")
+	}
+}
+
+// Size returns the terminal size the page last reported.
+func (t *webTerminal) Size() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.width, t.height
+}
+
+// Dumb is always false: the page understands the escapes the chat uses.
+func (t *webTerminal) Dumb() bool {
+	return false
+}
+
+func (t *webTerminal) RemoteAddr() net.Addr {
+	return t.addr
+}
+
+// Secure reports whether the page was loaded over HTTPS, by this server
+// or by the proxy in front of it.
+func (t *webTerminal) Secure() bool {
+	r := t.ws.Request()
+	if viaProxy(r) {
+		return r.Header.Get("X-Forwarded-Proto") == "https"
+	}
+	return r.TLS != nil
+}
+
+func (t *webTerminal) Kind() string {
+	return "web"
+}
+
+func (t *webTerminal) Close() error {
+	return t.ws.Close()
+}
+
+// serveWeb runs the web gateway on ln: the terminal page at / and the
+// WebSocket it connects to at /ws.
+func serveWeb(ln net.Listener, db *sql.DB) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webPage)
+	})
+	mux.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		handleConnection(newWebTerminal(ws), db)
+	}))
+	if err := http.Serve(ln, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("serving web gateway", "err", err)
+	}
+}